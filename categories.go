@@ -0,0 +1,53 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"strings"
+)
+
+// Category is a category the article belongs to.
+type Category struct {
+	Link    WikiLink
+	Name    string // name of the category, without the namespace
+	SortKey string // sort key of the article in the category
+}
+
+// resolveSortKeys sets the sort key of the categories without an explicit
+// one to the DEFAULTSORT key or, if not set, to the name of the page.
+func (a *Article) resolveSortKeys() {
+	def := a.defaultSort
+	if len(def) == 0 {
+		def = a.namespaces().WikiCanonicalFormNamespaceEsc(a.Title, "", true).PageName
+	}
+	for i := range a.Categories {
+		if len(a.Categories[i].SortKey) == 0 {
+			a.Categories[i].SortKey = def
+		}
+	}
+}
+
+// mfDefaultsort records the default sort key of the page. With the
+// noreplace option an earlier key is kept.
+func mfDefaultsort(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	key := strings.TrimSpace(arg0)
+	if len(a.defaultSort) > 0 && len(key) > 0 && strings.TrimSpace(argText(args, 0)) == "noreplace" {
+		return ""
+	}
+	a.defaultSort = key
+	return ""
+}
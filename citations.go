@@ -0,0 +1,488 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Citation is a source cited with one of the citation templates, such as
+// {{cite web}} or {{cite journal}}, with its parameters normalized.
+type Citation struct {
+	Key        string // identifier of the citation in the article, e.g. "smith2020"
+	Type       string // web, journal, book or news
+	Authors    []CitationName
+	Title      string
+	Container  string // website, journal, newspaper or encyclopedia
+	Publisher  string
+	Volume     string
+	Issue      string
+	Pages      string
+	Date       CitationDate
+	AccessDate CitationDate
+	URL        string
+	ArchiveURL string
+	DOI        string
+	ISBN       string
+	PMID       string
+	Template   *Template
+	Reference  *Reference // footnote the citation appears in, nil if not in a <ref>
+}
+
+// CitationName is the name of an author, split in family and given names
+// when the template does.
+type CitationName struct {
+	Family  string
+	Given   string
+	Literal string // the full name, when not split
+}
+
+// CitationDate is a possibly partial date of a citation.
+type CitationDate struct {
+	Raw   string // the text of the parameter
+	Year  int    // 0 if unknown
+	Month int    // 0 if unknown
+	Day   int    // 0 if unknown
+}
+
+// citationTemplates maps the names of the citation templates to the type
+// of the citation, empty for {{citation}} which has to guess it.
+var citationTemplates = map[string]string{
+	"Cite web":     "web",
+	"Cite journal": "journal",
+	"Cite book":    "book",
+	"Cite news":    "news",
+	"Citation":     "",
+}
+
+var citationContainers = map[string][]string{
+	"web":     {"website", "work"},
+	"journal": {"journal", "work"},
+	"book":    {"encyclopedia", "encyclopaedia", "work"},
+	"news":    {"newspaper", "work", "website"},
+}
+
+var citationLinksRe = regexp.MustCompile(`\[\[(?:[^|\]]*\|)?([^\]]*)\]\]`)
+var citationExtLinksRe = regexp.MustCompile(`\[[a-zA-Z][a-zA-Z0-9+.-]*:[^\] ]*(?: ([^\]]*))?\]`)
+var citationMarkupRe = regexp.MustCompile(`'{2,}|<[^>]*>|\x07(?:\d{7}|t[be]\d{5})`)
+var citationYearRe = regexp.MustCompile(`\b(\d{4})\b`)
+
+// citationText returns the plain text of a parameter value.
+func citationText(s string) string {
+	s = citationLinksRe.ReplaceAllString(s, "$1")
+	s = citationExtLinksRe.ReplaceAllString(s, "$1")
+	s = citationMarkupRe.ReplaceAllString(s, "")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+var citationDateLayouts = []struct {
+	layout string
+	day    bool
+}{
+	{"2006-01-02", true}, {"2 January 2006", true}, {"January 2, 2006", true}, {"2 Jan 2006", true}, {"Jan 2, 2006", true},
+	{"January 2006", false}, {"Jan 2006", false}, {"2006-01", false},
+}
+
+// parseCitationDate decodes the date formats accepted by the citation
+// templates, falling back to the year.
+func parseCitationDate(s string) CitationDate {
+	d := CitationDate{Raw: s}
+	if len(s) == 0 {
+		return d
+	}
+	for _, l := range citationDateLayouts {
+		t, err := time.Parse(l.layout, s)
+		if err != nil {
+			continue
+		}
+		d.Year, d.Month = t.Year(), int(t.Month())
+		if l.day {
+			d.Day = t.Day()
+		}
+		return d
+	}
+	if m := citationYearRe.FindStringSubmatch(s); m != nil {
+		d.Year, _ = strconv.Atoi(m[1])
+	}
+	return d
+}
+
+// citationParams returns the parameters of t with the names normalized:
+// lower case, without hyphens, underscores and spaces, so that e.g.
+// access-date and accessdate match.
+func citationParams(t *Template) map[string]string {
+	out := make(map[string]string, len(t.Parameters))
+	for k, v := range t.Parameters {
+		k = strings.Map(func(r rune) rune {
+			if r == '-' || r == '_' || unicode.IsSpace(r) {
+				return -1
+			}
+			return unicode.ToLower(r)
+		}, k)
+		if v = citationText(v); len(v) > 0 {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// citationAuthors collects the authors from the last/first parameters and
+// their numbered and aliased variants, up to the first missing number.
+func citationAuthors(p map[string]string) []CitationName {
+	out := make([]CitationName, 0, 2)
+	for i := 1; ; i++ {
+		suffixes := []string{strconv.Itoa(i)}
+		if i == 1 {
+			suffixes = append(suffixes, "")
+		}
+		var name CitationName
+		for _, sfx := range suffixes {
+			for _, k := range []string{"last", "surname", "authorlast", "author"} {
+				if v, ok := p[k+sfx]; ok && len(name.Family) == 0 {
+					name.Family = v
+				}
+			}
+			for _, k := range []string{"first", "given", "authorfirst"} {
+				if v, ok := p[k+sfx]; ok && len(name.Given) == 0 {
+					name.Given = v
+				}
+			}
+		}
+		if len(name.Family) == 0 {
+			break
+		}
+		if len(name.Given) == 0 {
+			name.Literal, name.Family = name.Family, ""
+		}
+		out = append(out, name)
+	}
+	if len(out) == 0 {
+		for _, k := range []string{"authors", "vauthors"} {
+			if v, ok := p[k]; ok {
+				out = append(out, CitationName{Literal: v})
+				break
+			}
+		}
+	}
+	return out
+}
+
+func firstParam(p map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := p[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// NewCitation returns the citation described by t, or nil if t is not a
+// citation template.
+func (a *Article) NewCitation(t *Template) *Citation {
+	if t.Typ != "normal" {
+		return nil
+	}
+	typ, ok := citationTemplates[a.namespaces().WikiCanonicalFormNamespaceEsc(t.Name, "Template", true).PageName]
+	if !ok {
+		return nil
+	}
+	p := citationParams(t)
+	if len(typ) == 0 {
+		switch {
+		case len(p["journal"]) > 0:
+			typ = "journal"
+		case len(p["newspaper"]) > 0:
+			typ = "news"
+		case len(p["isbn"]) > 0 || len(p["url"]) == 0:
+			typ = "book"
+		default:
+			typ = "web"
+		}
+	}
+	c := &Citation{
+		Type:       typ,
+		Authors:    citationAuthors(p),
+		Title:      firstParam(p, "title", "chapter"),
+		Container:  firstParam(p, citationContainers[typ]...),
+		Publisher:  p["publisher"],
+		Volume:     p["volume"],
+		Issue:      firstParam(p, "issue", "number"),
+		Pages:      firstParam(p, "pages", "page", "at"),
+		URL:        p["url"],
+		ArchiveURL: p["archiveurl"],
+		DOI:        p["doi"],
+		ISBN:       firstParam(p, "isbn", "isbn13"),
+		PMID:       p["pmid"],
+		Template:   t,
+	}
+	c.Date = parseCitationDate(firstParam(p, "date", "year"))
+	if y, ok := p["year"]; ok && c.Date.Year == 0 {
+		c.Date = parseCitationDate(y)
+	}
+	c.AccessDate = parseCitationDate(p["accessdate"])
+	return c
+}
+
+// Citations returns the citations of the article, in order of appearance,
+// with the footnote each was found in.
+func (a *Article) Citations() []*Citation {
+	refs := make(map[*Template]*Reference)
+	for _, r := range a.References {
+		for _, t := range r.Templates {
+			refs[t] = r
+		}
+	}
+	out := make([]*Citation, 0, 4)
+	used := make(map[string]bool)
+	suffixes := make(map[string]int)
+	for _, t := range a.Templates {
+		c := a.NewCitation(t)
+		if c == nil {
+			continue
+		}
+		c.Reference = refs[t]
+		base := c.baseKey()
+		c.Key = base
+		for used[c.Key] {
+			suffixes[base]++
+			c.Key = base + keySuffix(suffixes[base])
+		}
+		used[c.Key] = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// keySuffix returns the suffix of the n-th duplicate key: a to z, then aa,
+// ab and so on.
+func keySuffix(n int) string {
+	s := ""
+	for ; n > 0; n = (n - 1) / 26 {
+		s = string(rune('a'+(n-1)%26)) + s
+	}
+	return s
+}
+
+// baseKey builds a BibTeX style key from the first author and the year.
+func (c *Citation) baseKey() string {
+	name := "anon"
+	if len(c.Authors) > 0 {
+		name = c.Authors[0].Family
+		if len(name) == 0 {
+			f := strings.Fields(c.Authors[0].Literal)
+			name = f[len(f)-1]
+		}
+	}
+	key := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	if len(key) == 0 {
+		key = "anon"
+	}
+	if c.Date.Year > 0 {
+		key += strconv.Itoa(c.Date.Year)
+	}
+	return key
+}
+
+var cslTypes = map[string]string{
+	"web":     "webpage",
+	"journal": "article-journal",
+	"book":    "book",
+	"news":    "article-newspaper",
+}
+
+type cslName struct {
+	Family  string `json:"family,omitempty"`
+	Given   string `json:"given,omitempty"`
+	Literal string `json:"literal,omitempty"`
+}
+
+type cslDate struct {
+	DateParts [][]int `json:"date-parts,omitempty"`
+	Raw       string  `json:"raw,omitempty"`
+}
+
+type cslItem struct {
+	Id             string    `json:"id"`
+	Type           string    `json:"type"`
+	Title          string    `json:"title,omitempty"`
+	Author         []cslName `json:"author,omitempty"`
+	ContainerTitle string    `json:"container-title,omitempty"`
+	Publisher      string    `json:"publisher,omitempty"`
+	Volume         string    `json:"volume,omitempty"`
+	Issue          string    `json:"issue,omitempty"`
+	Page           string    `json:"page,omitempty"`
+	Issued         *cslDate  `json:"issued,omitempty"`
+	Accessed       *cslDate  `json:"accessed,omitempty"`
+	URL            string    `json:"URL,omitempty"`
+	ArchiveURL     string    `json:"archive_location,omitempty"`
+	DOI            string    `json:"DOI,omitempty"`
+	ISBN           string    `json:"ISBN,omitempty"`
+	PMID           string    `json:"PMID,omitempty"`
+}
+
+// iso formats the known parts of the date as in ISO 8601.
+func (d CitationDate) iso() string {
+	switch {
+	case d.Day > 0:
+		return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+	case d.Month > 0:
+		return fmt.Sprintf("%04d-%02d", d.Year, d.Month)
+	}
+	return fmt.Sprintf("%04d", d.Year)
+}
+
+func (d CitationDate) csl() *cslDate {
+	switch {
+	case d.Day > 0:
+		return &cslDate{DateParts: [][]int{{d.Year, d.Month, d.Day}}}
+	case d.Month > 0:
+		return &cslDate{DateParts: [][]int{{d.Year, d.Month}}}
+	case d.Year > 0:
+		return &cslDate{DateParts: [][]int{{d.Year}}}
+	case len(d.Raw) > 0:
+		return &cslDate{Raw: d.Raw}
+	}
+	return nil
+}
+
+// CSLJSON encodes the citations as a CSL-JSON array.
+func CSLJSON(citations []*Citation) ([]byte, error) {
+	items := make([]cslItem, 0, len(citations))
+	for _, c := range citations {
+		it := cslItem{
+			Id:             c.Key,
+			Type:           cslTypes[c.Type],
+			Title:          c.Title,
+			ContainerTitle: c.Container,
+			Publisher:      c.Publisher,
+			Volume:         c.Volume,
+			Issue:          c.Issue,
+			Page:           c.Pages,
+			Issued:         c.Date.csl(),
+			Accessed:       c.AccessDate.csl(),
+			URL:            c.URL,
+			ArchiveURL:     c.ArchiveURL,
+			DOI:            c.DOI,
+			ISBN:           c.ISBN,
+			PMID:           c.PMID,
+		}
+		for _, n := range c.Authors {
+			it.Author = append(it.Author, cslName(n))
+		}
+		items = append(items, it)
+	}
+	return json.MarshalIndent(items, "", "  ")
+}
+
+var bibtexTypes = map[string]string{
+	"web":     "misc",
+	"journal": "article",
+	"book":    "book",
+	"news":    "article",
+}
+
+var bibtexEscaper = strings.NewReplacer(`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`,
+	"$", `\$`, "#", `\#`, "_", `\_`, "~", `\textasciitilde{}`, "^", `\textasciicircum{}`)
+
+// bibtexURLEscaper escapes the verbatim fields, url and doi: only the
+// characters that could end the field are percent-encoded.
+var bibtexURLEscaper = strings.NewReplacer(`\`, "%5C", "{", "%7B", "}", "%7D")
+
+// BibTeX encodes the citations as BibTeX entries, using the biblatex fields
+// for the identifiers and the access date.
+func BibTeX(citations []*Citation) string {
+	var b strings.Builder
+	for _, c := range citations {
+		fields := make(map[string]string)
+		authors := make([]string, 0, len(c.Authors))
+		for _, n := range c.Authors {
+			if len(n.Literal) > 0 {
+				authors = append(authors, "{"+bibtexEscaper.Replace(n.Literal)+"}")
+			} else {
+				authors = append(authors, bibtexEscaper.Replace(n.Family+", "+n.Given))
+			}
+		}
+		if len(authors) > 0 {
+			fields["author"] = strings.Join(authors, " and ")
+		}
+		set := func(k, v string) {
+			if len(v) > 0 {
+				fields[k] = bibtexEscaper.Replace(v)
+			}
+		}
+		set("title", c.Title)
+		switch c.Type {
+		case "journal", "news":
+			set("journal", c.Container)
+		case "book":
+			set("booktitle", c.Container)
+		default:
+			set("howpublished", c.Container)
+		}
+		set("publisher", c.Publisher)
+		set("volume", c.Volume)
+		set("number", c.Issue)
+		set("pages", c.Pages)
+		if c.Date.Year > 0 {
+			fields["year"] = strconv.Itoa(c.Date.Year)
+		}
+		if c.Date.Month > 0 {
+			fields["month"] = strconv.Itoa(c.Date.Month)
+		}
+		if c.AccessDate.Year > 0 {
+			fields["urldate"] = c.AccessDate.iso()
+		}
+		if len(c.URL) > 0 {
+			fields["url"] = bibtexURLEscaper.Replace(c.URL)
+		}
+		if len(c.ArchiveURL) > 0 {
+			fields["note"] = `Archived at \url{` + bibtexURLEscaper.Replace(c.ArchiveURL) + "}"
+		}
+		if len(c.DOI) > 0 {
+			fields["doi"] = bibtexURLEscaper.Replace(c.DOI)
+		}
+		set("isbn", c.ISBN)
+		if len(c.PMID) > 0 {
+			fields["eprint"] = c.PMID
+			fields["eprinttype"] = "pubmed"
+		}
+		names := make([]string, 0, len(fields))
+		for k := range fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		b.WriteString("@" + bibtexTypes[c.Type] + "{" + c.Key)
+		for _, k := range names {
+			b.WriteString(",\n  " + k + " = {" + fields[k] + "}")
+		}
+		b.WriteString("\n}\n")
+	}
+	return b.String()
+}
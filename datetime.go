@@ -0,0 +1,551 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implementation of the {{#time}} and {{#timel}} parser functions: date
+// input in the formats accepted by PHP's strtotime (the common ones) and
+// output through PHP/MediaWiki date format codes.
+
+var errInvalidTime = errors.New("Error: Invalid time.")
+
+func pfTime(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return a.formatTime(arg0, argText(args, 0), len(args) > 2 && len(args[2].text()) > 0)
+}
+
+func pfTimel(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return a.formatTime(arg0, argText(args, 0), true)
+}
+
+func (a *Article) formatTime(format, date string, local bool) string {
+	pc := a.context()
+	t, err := ParseTime(date, pc.Now)
+	if err != nil {
+		return `<strong class="error">` + err.Error() + `</strong>`
+	}
+	if local {
+		t = t.In(pc.Location)
+	} else {
+		t = t.UTC()
+	}
+	switch {
+	case t.Year() < 0:
+		return `<strong class="error">Error: #time only supports years from 0.</strong>`
+	case t.Year() > 9999:
+		return `<strong class="error">Error: #time only supports years up to 9999.</strong>`
+	}
+	return FormatTime(format, t)
+}
+
+var monthNames = []string{"january", "february", "march", "april", "may", "june", "july",
+	"august", "september", "october", "november", "december"}
+var dayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+func monthIndex(s string) int {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) < 3 {
+		return 0
+	}
+	if s == "sept" {
+		return 9
+	}
+	for i, m := range monthNames {
+		if s == m || s == m[:3] {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func dayIndex(s string) int {
+	if len(s) < 3 {
+		return -1
+	}
+	for i, d := range dayNames {
+		if s == d || s == d[:3] {
+			return i
+		}
+	}
+	return -1
+}
+
+const monthRe = `(jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sept?(?:ember)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)\.?`
+
+var (
+	tUnixRe      = regexp.MustCompile(`^@(-?\d+)`)
+	tISORe       = regexp.MustCompile(`^(\d{4})-(\d{1,2})-(\d{1,2})(?:t(\d{1,2}):(\d{2})(?::(\d{2}))?(?:\.\d+)?)?`)
+	tYearMonthRe = regexp.MustCompile(`^(\d{4})-(\d{1,2})\b`)
+	tSlashYMDRe  = regexp.MustCompile(`^(\d{4})/(\d{1,2})/(\d{1,2})`)
+	tSlashMDYRe  = regexp.MustCompile(`^(\d{1,2})/(\d{1,2})/(\d{4})`)
+	tDotDMYRe    = regexp.MustCompile(`^(\d{1,2})[.-](\d{1,2})[.-](\d{4})`)
+	tCompactRe   = regexp.MustCompile(`^(\d{4})(\d{2})(\d{2})(?:(\d{2})(\d{2})(\d{2}))?\b`)
+	tTimeRe      = regexp.MustCompile(`^(\d{1,2}):(\d{2})(?::(\d{2}))?(?:\.\d+)?(?:\s*(am|pm|a\.m\.|p\.m\.))?`)
+	tHourAmPmRe  = regexp.MustCompile(`^(\d{1,2})\s*(am|pm|a\.m\.|p\.m\.)`)
+	tDayMonthRe  = regexp.MustCompile(`^(\d{1,2})(?:st|nd|rd|th)?\s*[ -]\s*` + monthRe + `(?:[ ,-]\s*(\d{1,4})\b)?`)
+	tMonthYearRe = regexp.MustCompile(`^` + monthRe + `[ ,-]\s*(\d{4})\b`)
+	tMonthDayRe  = regexp.MustCompile(`^` + monthRe + `\s+(\d{1,2})(?:st|nd|rd|th)?\b(?:,?\s*(\d{4})\b)?`)
+	tMonthRe     = regexp.MustCompile(`^` + monthRe + `\b`)
+	tYearRe      = regexp.MustCompile(`^(\d{4})\b`)
+	tYearOnlyRe  = regexp.MustCompile(`^\d{4}$`)
+	tRelRe       = regexp.MustCompile(`^([+-]?)\s*(\d+)\s*(sec|second|min|minute|hour|day|week|fortnight|month|year)s?\b`)
+	tRelWordRe   = regexp.MustCompile(`^(next|last|previous|this)\s+([a-z]+)\b`)
+	tDayOfRe     = regexp.MustCompile(`^(first|last)\s+day\s+of\b`)
+	tZoneRe      = regexp.MustCompile(`^(utc|gmt|z)\b`)
+	tOffsetRe    = regexp.MustCompile(`^([+-])(\d{2}):?(\d{2})\b`)
+	tWordRe      = regexp.MustCompile(`^[a-z]+`)
+)
+
+// timeSpec collects the parts of a date string before they are combined.
+type timeSpec struct {
+	year, month, day     int
+	hasDate, hasTime     bool
+	hour, min, sec       int
+	rel                  [6]int // years, months, days, hours, minutes, seconds
+	weekday              int    // -1 if none
+	weekdayDir           int    // 0 this (on or after), 1 next, -1 last
+	dayOf                string // "first" or "last" day of the resulting month
+	offset               int    // time zone offset in seconds
+	unix                 *int64
+	hasMonthOnly, hasDay bool
+}
+
+func atoi(s string) int {
+	v, _ := strconv.Atoi(s)
+	return v
+}
+
+func to24(h int, ampm string) int {
+	switch {
+	case strings.HasPrefix(ampm, "a") && h == 12:
+		return 0
+	case strings.HasPrefix(ampm, "p") && h < 12:
+		return h + 12
+	}
+	return h
+}
+
+func relUnit(unit string) (int, int) {
+	switch unit {
+	case "sec", "second":
+		return 5, 1
+	case "min", "minute":
+		return 4, 1
+	case "hour":
+		return 3, 1
+	case "day":
+		return 2, 1
+	case "week":
+		return 2, 7
+	case "fortnight":
+		return 2, 14
+	case "month":
+		return 1, 1
+	case "year":
+		return 0, 1
+	}
+	return -1, 0
+}
+
+// ParseTime parses a date and time in the formats accepted by the {{#time}}
+// parser function, relative to now. Dates without a time zone are taken to
+// be in UTC.
+func ParseTime(date string, now time.Time) (time.Time, error) {
+	s := strings.ToLower(strings.TrimSpace(date))
+	now = now.UTC()
+	if len(s) == 0 {
+		return now, nil
+	}
+	if tYearOnlyRe.MatchString(s) {
+		// a four digit number is a year, not a time
+		s = "00:00 " + s
+	}
+	ts := timeSpec{weekday: -1}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t\n,")
+		if len(s) == 0 {
+			break
+		}
+		var m []string
+		match := func(re *regexp.Regexp) bool {
+			m = re.FindStringSubmatch(s)
+			if m == nil {
+				return false
+			}
+			s = s[len(m[0]):]
+			return true
+		}
+		setDate := func(y, mo, d int) {
+			ts.year, ts.month, ts.day = y, mo, d
+			ts.hasDate, ts.hasDay = true, true
+		}
+		switch {
+		case match(tUnixRe):
+			v, err := strconv.ParseInt(m[1], 10, 64)
+			if err != nil {
+				return now, errInvalidTime
+			}
+			ts.unix = &v
+		case match(tISORe):
+			setDate(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+			if len(m[4]) > 0 {
+				ts.hour, ts.min, ts.sec, ts.hasTime = atoi(m[4]), atoi(m[5]), atoi(m[6]), true
+			}
+		case match(tCompactRe):
+			setDate(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+			if len(m[4]) > 0 {
+				ts.hour, ts.min, ts.sec, ts.hasTime = atoi(m[4]), atoi(m[5]), atoi(m[6]), true
+			}
+		case match(tYearMonthRe):
+			setDate(atoi(m[1]), atoi(m[2]), 1)
+		case match(tSlashYMDRe):
+			setDate(atoi(m[1]), atoi(m[2]), atoi(m[3]))
+		case match(tSlashMDYRe):
+			setDate(atoi(m[3]), atoi(m[1]), atoi(m[2]))
+		case match(tDotDMYRe):
+			setDate(atoi(m[3]), atoi(m[2]), atoi(m[1]))
+		case match(tTimeRe):
+			ts.hour, ts.min, ts.sec, ts.hasTime = to24(atoi(m[1]), m[4]), atoi(m[2]), atoi(m[3]), true
+		case match(tHourAmPmRe):
+			ts.hour, ts.min, ts.sec, ts.hasTime = to24(atoi(m[1]), m[2]), 0, 0, true
+		case match(tDayMonthRe):
+			y := now.Year()
+			if ts.hasDate {
+				y = ts.year
+			}
+			if len(m[3]) > 0 {
+				y = atoi(m[3])
+			}
+			setDate(y, monthIndex(m[2]), atoi(m[1]))
+		case match(tMonthYearRe):
+			setDate(atoi(m[2]), monthIndex(m[1]), 1)
+		case match(tMonthDayRe):
+			y := now.Year()
+			if len(m[3]) > 0 {
+				y = atoi(m[3])
+			}
+			setDate(y, monthIndex(m[1]), atoi(m[2]))
+		case match(tMonthRe):
+			ts.month, ts.hasMonthOnly = monthIndex(m[1]), true
+		case match(tYearRe):
+			if ts.hasDate {
+				ts.year = atoi(m[1])
+			} else {
+				setDate(atoi(m[1]), int(now.Month()), now.Day())
+			}
+		case match(tRelRe):
+			n := atoi(m[2])
+			if m[1] == "-" {
+				n = -n
+			}
+			i, mult := relUnit(m[3])
+			ts.rel[i] += n * mult
+		case match(tOffsetRe):
+			off := atoi(m[2])*3600 + atoi(m[3])*60
+			if m[1] == "-" {
+				off = -off
+			}
+			ts.offset = off
+		case match(tDayOfRe):
+			ts.dayOf = m[1]
+		case match(tRelWordRe):
+			n := 0
+			switch m[1] {
+			case "next":
+				n = 1
+			case "last", "previous":
+				n = -1
+			}
+			if d := dayIndex(m[2]); d >= 0 {
+				ts.weekday, ts.weekdayDir = d, n
+				ts.hasTime = true
+				continue
+			}
+			if mo := monthIndex(m[2]); mo > 0 {
+				ts.month, ts.hasMonthOnly = mo, true
+				ts.rel[0] += n
+				continue
+			}
+			i, mult := relUnit(strings.TrimSuffix(m[2], "s"))
+			if i < 0 {
+				return now, errInvalidTime
+			}
+			if i == 2 && mult == 7 && n != 0 {
+				ts.rel[2] += 7 * n
+				continue
+			}
+			ts.rel[i] += n * mult
+		case match(tZoneRe):
+		case match(tWordRe):
+			switch w := m[0]; {
+			case w == "now":
+			case w == "today" || w == "midnight":
+				ts.hasTime = true
+			case w == "noon":
+				ts.hour, ts.min, ts.sec, ts.hasTime = 12, 0, 0, true
+			case w == "tomorrow":
+				ts.rel[2]++
+				ts.hasTime = true
+			case w == "yesterday":
+				ts.rel[2]--
+				ts.hasTime = true
+			case w == "ago":
+				for i := range ts.rel {
+					ts.rel[i] = -ts.rel[i]
+				}
+			case w == "of" || w == "at" || w == "t" || w == "the":
+			case dayIndex(w) >= 0:
+				ts.weekday, ts.weekdayDir = dayIndex(w), 0
+				ts.hasTime = true
+			default:
+				return now, errInvalidTime
+			}
+		default:
+			return now, errInvalidTime
+		}
+	}
+	return ts.resolve(now)
+}
+
+func (ts *timeSpec) resolve(now time.Time) (time.Time, error) {
+	if ts.unix != nil {
+		return time.Unix(*ts.unix, 0).UTC(), nil
+	}
+	y, mo, d := now.Date()
+	h, mi, sec := now.Clock()
+	if ts.hasMonthOnly {
+		mo = time.Month(ts.month)
+		h, mi, sec = 0, 0, 0
+	}
+	if ts.hasDate {
+		y, mo, d = ts.year, time.Month(ts.month), ts.day
+		if ts.month < 1 || ts.month > 12 || ts.day < 1 || ts.day > 31 {
+			return now, errInvalidTime
+		}
+		h, mi, sec = 0, 0, 0
+	}
+	if ts.hasTime {
+		if ts.hour > 24 || ts.min > 59 || ts.sec > 60 {
+			return now, errInvalidTime
+		}
+		h, mi, sec = ts.hour, ts.min, ts.sec
+	}
+	t := time.Date(y, mo, d, h, mi, sec, 0, time.UTC)
+	t = t.Add(-time.Duration(ts.offset) * time.Second)
+	if ts.dayOf != "" {
+		// the day is chosen after applying the relative months
+		t = time.Date(t.Year(), t.Month()+time.Month(ts.rel[1]), 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+		t = t.AddDate(ts.rel[0], 0, 0)
+		if ts.dayOf == "last" {
+			t = t.AddDate(0, 1, -1)
+		}
+		t = t.AddDate(0, 0, ts.rel[2])
+	} else {
+		t = t.AddDate(ts.rel[0], ts.rel[1], ts.rel[2])
+	}
+	t = t.Add(time.Duration(ts.rel[3])*time.Hour + time.Duration(ts.rel[4])*time.Minute + time.Duration(ts.rel[5])*time.Second)
+	if ts.weekday >= 0 {
+		diff := (ts.weekday - int(t.Weekday()) + 7) % 7
+		switch ts.weekdayDir {
+		case 1:
+			if diff == 0 {
+				diff = 7
+			}
+		case -1:
+			diff -= 7
+			if diff == 0 {
+				diff = -7
+			}
+		}
+		t = t.AddDate(0, 0, diff)
+	}
+	return t, nil
+}
+
+var romanNumerals = []struct {
+	v int
+	s string
+}{{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+	{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"}}
+
+func romanNumeral(n int) string {
+	if n <= 0 || n > 10000 {
+		return strconv.Itoa(n)
+	}
+	out := ""
+	for _, r := range romanNumerals {
+		for n >= r.v {
+			out += r.s
+			n -= r.v
+		}
+	}
+	return out
+}
+
+// FormatTime formats t according to the PHP date format codes used by
+// MediaWiki's {{#time}}, including the MediaWiki specific x codes.
+func FormatTime(format string, t time.Time) string {
+	out := make([]byte, 0, len(format)*2)
+	roman := false
+	num := func(n int, pad int) {
+		if roman {
+			out = append(out, romanNumeral(n)...)
+			roman = false
+			return
+		}
+		out = append(out, fmt.Sprintf("%0*d", pad, n)...)
+	}
+	f := []rune(format)
+	for i := 0; i < len(f); i++ {
+		c := f[i]
+		switch c {
+		case 'x':
+			if i+1 >= len(f) {
+				out = append(out, 'x')
+				continue
+			}
+			i++
+			switch f[i] {
+			case 'x':
+				out = append(out, 'x')
+			case 'g':
+				out = append(out, t.Month().String()...)
+			case 'r':
+				roman = true
+			case 'n', 'N', 'h':
+				// raw and Hebrew numerals are not localized here
+			case 'k':
+				if i+1 < len(f) && f[i+1] == 'Y' {
+					i++
+					num(t.Year()+543, 0)
+				}
+			case 'o':
+				if i+1 < len(f) && f[i+1] == 'Y' {
+					i++
+					num(t.Year()-1911, 0)
+				}
+			case 'i', 'j', 'm', 't':
+				// other calendars are not supported, the code that
+				// follows gives the Gregorian value
+			default:
+				out = append(out, 'x')
+				i--
+			}
+		case 'Y':
+			num(t.Year(), 4)
+		case 'y':
+			num(t.Year()%100, 2)
+		case 'L':
+			y := t.Year()
+			num(int(boolFloat(y%4 == 0 && (y%100 != 0 || y%400 == 0))), 0)
+		case 'o':
+			y, _ := t.ISOWeek()
+			num(y, 4)
+		case 'n':
+			num(int(t.Month()), 0)
+		case 'm':
+			num(int(t.Month()), 2)
+		case 'M':
+			out = append(out, t.Month().String()[:3]...)
+		case 'F':
+			out = append(out, t.Month().String()...)
+		case 'j':
+			num(t.Day(), 0)
+		case 'd':
+			num(t.Day(), 2)
+		case 'z':
+			num(t.YearDay()-1, 0)
+		case 'D':
+			out = append(out, t.Weekday().String()[:3]...)
+		case 'l':
+			out = append(out, t.Weekday().String()...)
+		case 'N':
+			wd := int(t.Weekday())
+			if wd == 0 {
+				wd = 7
+			}
+			num(wd, 0)
+		case 'w':
+			num(int(t.Weekday()), 0)
+		case 'W':
+			_, w := t.ISOWeek()
+			num(w, 2)
+		case 't':
+			num(time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day(), 0)
+		case 'a':
+			out = append(out, t.Format("pm")...)
+		case 'A':
+			out = append(out, t.Format("PM")...)
+		case 'g':
+			num((t.Hour()+11)%12+1, 0)
+		case 'h':
+			num((t.Hour()+11)%12+1, 2)
+		case 'G':
+			num(t.Hour(), 0)
+		case 'H':
+			num(t.Hour(), 2)
+		case 'i':
+			num(t.Minute(), 2)
+		case 's':
+			num(t.Second(), 2)
+		case 'U':
+			out = append(out, strconv.FormatInt(t.Unix(), 10)...)
+		case 'e':
+			out = append(out, t.Location().String()...)
+		case 'I':
+			num(int(boolFloat(t.IsDST())), 0)
+		case 'O':
+			out = append(out, t.Format("-0700")...)
+		case 'P':
+			out = append(out, t.Format("-07:00")...)
+		case 'T':
+			out = append(out, t.Format("MST")...)
+		case 'Z':
+			_, off := t.Zone()
+			out = append(out, strconv.Itoa(off)...)
+		case 'c':
+			out = append(out, t.Format("2006-01-02T15:04:05-07:00")...)
+		case 'r':
+			out = append(out, t.Format("Mon, 02 Jan 2006 15:04:05 -0700")...)
+		case '\\':
+			if i+1 < len(f) {
+				i++
+				out = append(out, string(f[i])...)
+			} else {
+				out = append(out, '\\')
+			}
+		case '"':
+			if j := strings.IndexRune(string(f[i+1:]), '"'); j >= 0 {
+				lit := string(f[i+1:])[:j]
+				out = append(out, lit...)
+				i += len([]rune(lit)) + 1
+			} else {
+				out = append(out, '"')
+			}
+		default:
+			out = append(out, string(c)...)
+		}
+	}
+	return string(out)
+}
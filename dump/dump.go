@@ -0,0 +1,251 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dump reads the XML dumps of MediaWiki wikis, such as the
+// pages-articles.xml.bz2 files of Wikipedia, one page at a time.
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m-m-f/gowiki"
+)
+
+// Contributor is the author of a revision. Anonymous edits only have an IP.
+type Contributor struct {
+	Username string `xml:"username"`
+	Id       int64  `xml:"id"`
+	IP       string `xml:"ip"`
+}
+
+// Page is a page of the dump with its (last) revision.
+type Page struct {
+	Title       string
+	Namespace   int
+	Id          int64
+	Redirect    string // title of the redirect target, if the page is a redirect
+	RevisionId  int64
+	Timestamp   time.Time
+	Contributor Contributor
+	Model       string
+	Format      string
+	Text        string
+}
+
+// Namespace is a namespace declared in the siteinfo of the dump.
+type Namespace struct {
+	Key  int    `xml:"key,attr"`
+	Case string `xml:"case,attr"`
+	Name string `xml:",chardata"`
+}
+
+// SiteInfo is the description of the wiki found at the start of the dump.
+type SiteInfo struct {
+	SiteName   string      `xml:"sitename"`
+	DBName     string      `xml:"dbname"`
+	Base       string      `xml:"base"`
+	Generator  string      `xml:"generator"`
+	Case       string      `xml:"case"`
+	Namespaces []Namespace `xml:"namespaces>namespace"`
+}
+
+type xmlRevision struct {
+	Id          int64       `xml:"id"`
+	Timestamp   string      `xml:"timestamp"`
+	Contributor Contributor `xml:"contributor"`
+	Model       string      `xml:"model"`
+	Format      string      `xml:"format"`
+	Text        string      `xml:"text"`
+}
+
+// Reader reads the pages of a dump. The dump can be compressed with bzip2
+// or gzip.
+type Reader struct {
+	SiteInfo *SiteInfo // set once the siteinfo element has been read
+	dec      *xml.Decoder
+	closer   io.Closer
+}
+
+// NewReader returns a Reader for the dump read from r, which may be
+// compressed with bzip2 or gzip.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	out := &Reader{}
+	var in io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		in = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		in = gz
+		out.closer = gz
+	}
+	out.dec = xml.NewDecoder(in)
+	return out, nil
+}
+
+// Next returns the next page of the dump, or io.EOF once all the pages have
+// been read. Only one page is held in memory at a time. For dumps with the
+// full history, the page holds its last revision.
+func (r *Reader) Next() (*Page, error) {
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "siteinfo":
+			si := &SiteInfo{}
+			if err := r.dec.DecodeElement(si, &se); err != nil {
+				return nil, err
+			}
+			r.SiteInfo = si
+		case "page":
+			return r.readPage()
+		}
+	}
+}
+
+// Close releases the resources of the decompressor, if any. It does not
+// close the underlying reader.
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// readPage reads the children of a page element one at a time. Each
+// revision replaces the previous one, so that only one revision text is
+// held in memory even for the dumps with the full history.
+func (r *Reader) readPage() (*Page, error) {
+	p := &Page{}
+	var rev *xmlRevision
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := t.(xml.EndElement); ok {
+			break
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "title":
+			err = r.dec.DecodeElement(&p.Title, &se)
+		case "ns":
+			err = r.dec.DecodeElement(&p.Namespace, &se)
+		case "id":
+			err = r.dec.DecodeElement(&p.Id, &se)
+		case "redirect":
+			for _, a := range se.Attr {
+				if a.Name.Local == "title" {
+					p.Redirect = a.Value
+				}
+			}
+			err = r.dec.Skip()
+		case "revision":
+			rev = &xmlRevision{}
+			err = r.dec.DecodeElement(rev, &se)
+		default:
+			err = r.dec.Skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rev == nil {
+		return p, nil
+	}
+	p.RevisionId = rev.Id
+	p.Contributor = rev.Contributor
+	p.Model = rev.Model
+	p.Format = rev.Format
+	p.Text = rev.Text
+	if len(rev.Timestamp) > 0 {
+		ts, err := time.Parse(time.RFC3339, rev.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		p.Timestamp = ts
+	}
+	return p, nil
+}
+
+// PageContext returns the page context describing the wiki of the dump,
+// including its namespaces.
+func (si *SiteInfo) PageContext() *gowiki.PageContext {
+	pc := &gowiki.PageContext{}
+	if si == nil {
+		return pc
+	}
+	pc.SiteName = si.SiteName
+	if len(si.Namespaces) > 0 {
+		list := make([]gowiki.Namespace, 0, len(si.Namespaces))
+		for _, n := range si.Namespaces {
+			ns := gowiki.DefaultNamespace(n.Key, n.Name)
+			ns.CaseSensitive = n.Case == "case-sensitive"
+			list = append(list, ns)
+		}
+		pc.Namespaces = gowiki.NewNamespaceTable(list)
+	}
+	if u, err := url.Parse(si.Base); err == nil && len(u.Host) > 0 {
+		pc.Server = "//" + u.Host
+		if i := strings.LastIndex(u.Path, "/"); i >= 0 {
+			pc.ArticlePath = u.Path[:i+1] + "$1"
+		}
+	}
+	return pc
+}
+
+// Parse parses the text of the page. The revision fields of site (which
+// can be nil) are set from the page.
+func (p *Page) Parse(g gowiki.PageGetter, site *gowiki.PageContext) (*gowiki.Article, error) {
+	pc := gowiki.PageContext{}
+	if site != nil {
+		pc = *site
+	}
+	pc.PageId = p.Id
+	pc.RevisionId = p.RevisionId
+	pc.RevisionTimestamp = p.Timestamp
+	pc.RevisionUser = p.Contributor.Username
+	if len(pc.RevisionUser) == 0 {
+		pc.RevisionUser = p.Contributor.IP
+	}
+	return gowiki.ParseArticleWithContext(p.Title, p.Text, g, &pc)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dump
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-m-f/gowiki"
+)
+
+const testDump = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10" xml:lang="en">
+  <siteinfo>
+    <sitename>Wikipedia</sitename>
+    <dbname>enwiki</dbname>
+    <base>https://en.wikipedia.org/wiki/Main_Page</base>
+    <case>first-letter</case>
+    <namespaces>
+      <namespace key="0" case="first-letter" />
+      <namespace key="14" case="first-letter">Category</namespace>
+    </namespaces>
+  </siteinfo>
+  <page>
+    <title>AccessibleComputing</title>
+    <ns>0</ns>
+    <id>10</id>
+    <redirect title="Computer accessibility" />
+    <revision>
+      <id>631144794</id>
+      <timestamp>2014-10-26T04:50:23Z</timestamp>
+      <contributor><username>Paine Ellsworth</username><id>9092818</id></contributor>
+      <model>wikitext</model>
+      <format>text/x-wiki</format>
+      <text xml:space="preserve">#REDIRECT [[Computer accessibility]]</text>
+    </revision>
+  </page>
+  <page>
+    <title>Anarchism</title>
+    <ns>0</ns>
+    <id>12</id>
+    <revision>
+      <id>41</id>
+      <timestamp>2016-02-01T10:00:00Z</timestamp>
+      <contributor><username>Old</username><id>1</id></contributor>
+      <comment>first version</comment>
+      <text xml:space="preserve">Old text.</text>
+    </revision>
+    <revision>
+      <id>42</id>
+      <timestamp>2016-03-01T10:00:00Z</timestamp>
+      <contributor><ip>127.0.0.1</ip></contributor>
+      <model>wikitext</model>
+      <format>text/x-wiki</format>
+      <text xml:space="preserve">'''Anarchism''' is a [[political philosophy]] ({{REVISIONID}}, {{SITENAME}}).</text>
+    </revision>
+  </page>
+</mediawiki>`
+
+func readAll(t *testing.T, in io.Reader) (*Reader, []*Page) {
+	r, err := NewReader(in)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	defer r.Close()
+	pages := make([]*Page, 0, 2)
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Error:", err)
+		}
+		pages = append(pages, p)
+	}
+	return r, pages
+}
+
+func TestReader(t *testing.T) {
+	r, pages := readAll(t, bytes.NewBufferString(testDump))
+	if r.SiteInfo == nil || r.SiteInfo.DBName != "enwiki" || len(r.SiteInfo.Namespaces) != 2 {
+		t.Fatalf("Error: wrong siteinfo %#v", r.SiteInfo)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Error: read %d pages, expected 2", len(pages))
+	}
+	p := pages[0]
+	if p.Title != "AccessibleComputing" || p.Id != 10 || p.Redirect != "Computer accessibility" ||
+		p.RevisionId != 631144794 || p.Contributor.Username != "Paine Ellsworth" || p.Model != "wikitext" ||
+		!p.Timestamp.Equal(time.Date(2014, 10, 26, 4, 50, 23, 0, time.UTC)) {
+		t.Errorf("Error: wrong page %#v", p)
+	}
+	if p = pages[1]; p.RevisionId != 42 || len(p.Contributor.Username) != 0 || p.Text == "Old text." {
+		t.Errorf("Error: the last revision should be kept %#v", p)
+	}
+	a, err := pages[1].Parse(&gowiki.DummyPageGetter{}, r.SiteInfo.PageContext())
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := "Anarchism is a political philosophy (42, Wikipedia).\n"
+	if txt := a.GetText(); txt != expected {
+		t.Errorf("Error: page text is %q, expected %q", txt, expected)
+	}
+	if len(a.Links) != 1 || a.Links[0].PageName != "Political philosophy" {
+		t.Errorf("Error: wrong links %v", a.Links)
+	}
+}
+
+func TestReaderGzip(t *testing.T) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(testDump))
+	w.Close()
+	_, pages := readAll(t, &b)
+	if len(pages) != 2 || pages[1].Title != "Anarchism" || pages[1].Contributor.IP != "127.0.0.1" {
+		t.Errorf("Error: wrong pages from gzip dump")
+	}
+}
+
+func TestReaderBzip2(t *testing.T) {
+	// the standard library cannot compress with bzip2: the fixture is
+	// testDump compressed with the bzip2 command
+	f, err := os.Open("testdata/dump.xml.bz2")
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	defer f.Close()
+	r, pages := readAll(t, f)
+	if r.SiteInfo == nil || r.SiteInfo.SiteName != "Wikipedia" {
+		t.Errorf("Error: wrong siteinfo from bzip2 dump %#v", r.SiteInfo)
+	}
+	if len(pages) != 2 || pages[1].Title != "Anarchism" || pages[1].RevisionId != 42 || pages[1].Contributor.IP != "127.0.0.1" {
+		t.Errorf("Error: wrong pages from bzip2 dump")
+	}
+}
@@ -0,0 +1,465 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Evaluator for the {{#expr}} parser function, following the operator set
+// and precedence rules of MediaWiki's ExprParser.
+
+const (
+	exprOpen = iota
+	exprClose
+	exprNegative
+	exprPositive
+	exprNot
+	exprSine
+	exprCosine
+	exprTangens
+	exprArcSine
+	exprArcCos
+	exprArcTan
+	exprExp
+	exprLn
+	exprAbs
+	exprFloor
+	exprTrunc
+	exprCeil
+	exprSqrt
+	exprExponent
+	exprPow
+	exprTimes
+	exprDivide
+	exprMod
+	exprFMod
+	exprPlus
+	exprMinus
+	exprRound
+	exprEquality
+	exprLess
+	exprGreater
+	exprLessEq
+	exprGreaterEq
+	exprNotEq
+	exprAnd
+	exprOr
+	exprPi
+	exprE
+)
+
+var exprPrecedence = map[int]int{
+	exprNegative: 10, exprPositive: 10, exprExponent: 10,
+	exprSine: 9, exprCosine: 9, exprTangens: 9, exprArcSine: 9, exprArcCos: 9, exprArcTan: 9,
+	exprExp: 9, exprLn: 9, exprAbs: 9, exprFloor: 9, exprTrunc: 9, exprCeil: 9, exprNot: 9, exprSqrt: 9,
+	exprPow:   8,
+	exprTimes: 7, exprDivide: 7, exprMod: 7, exprFMod: 7,
+	exprPlus: 6, exprMinus: 6,
+	exprRound:    5,
+	exprEquality: 4, exprLess: 4, exprGreater: 4, exprLessEq: 4, exprGreaterEq: 4, exprNotEq: 4,
+	exprAnd: 3,
+	exprOr:  2,
+	exprPi:  0, exprE: 0,
+	exprOpen: -1, exprClose: -1,
+}
+
+var exprNames = map[int]string{
+	exprNegative: "-", exprPositive: "+", exprNot: "not",
+	exprSine: "sin", exprCosine: "cos", exprTangens: "tan", exprArcSine: "asin", exprArcCos: "acos", exprArcTan: "atan",
+	exprExp: "exp", exprLn: "ln", exprAbs: "abs", exprFloor: "floor", exprTrunc: "trunc", exprCeil: "ceil", exprSqrt: "sqrt",
+	exprExponent: "e", exprPow: "^", exprTimes: "*", exprDivide: "/", exprMod: "mod", exprFMod: "fmod",
+	exprPlus: "+", exprMinus: "-", exprRound: "round",
+	exprEquality: "=", exprLess: "<", exprGreater: ">", exprLessEq: "<=", exprGreaterEq: ">=", exprNotEq: "<>",
+	exprAnd: "and", exprOr: "or", exprPi: "pi",
+}
+
+var exprWords = map[string]int{
+	"mod": exprMod, "fmod": exprFMod, "and": exprAnd, "or": exprOr, "not": exprNot,
+	"round": exprRound, "div": exprDivide, "e": exprExponent, "pi": exprPi,
+	"sin": exprSine, "cos": exprCosine, "tan": exprTangens, "asin": exprArcSine, "acos": exprArcCos, "atan": exprArcTan,
+	"exp": exprExp, "ln": exprLn, "abs": exprAbs, "trunc": exprTrunc, "floor": exprFloor, "ceil": exprCeil, "sqrt": exprSqrt,
+}
+
+func isUnaryExprOp(op int) bool {
+	return op != exprExponent && exprPrecedence[op] >= 9
+}
+
+func exprError(msg string) error {
+	return errors.New("Expression error: " + msg)
+}
+
+// EvalExpr evaluates a MediaWiki #expr expression, returning the result
+// formatted as MediaWiki does.
+func EvalExpr(expr string) (string, error) {
+	operands := make([]float64, 0, 8)
+	operators := make([]int, 0, 8)
+	expecting := "expression"
+	p := 0
+	end := len(expr)
+
+	doOp := func(op int) error {
+		var err error
+		operands, err = exprDoOperation(op, operands)
+		return err
+	}
+	pushOp := func(op int) error {
+		// shunting yard: binary operators are left associative
+		for len(operators) > 0 && exprPrecedence[op] <= exprPrecedence[operators[len(operators)-1]] {
+			if err := doOp(operators[len(operators)-1]); err != nil {
+				return err
+			}
+			operators = operators[:len(operators)-1]
+		}
+		operators = append(operators, op)
+		return nil
+	}
+
+	for p < end {
+		if len(operands) > 100 || len(operators) > 100 {
+			return "", exprError("Stack exhausted.")
+		}
+		c := expr[p]
+		r, rl := utf8.DecodeRuneInString(expr[p:])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p++
+			continue
+		case c >= '0' && c <= '9' || c == '.':
+			if expecting != "expression" {
+				return "", exprError("Unexpected number.")
+			}
+			l := 0
+			for p+l < end && (expr[p+l] >= '0' && expr[p+l] <= '9' || expr[p+l] == '.') {
+				l++
+			}
+			operands = append(operands, phpFloatVal(expr[p:p+l]))
+			p += l
+			expecting = "operator"
+			continue
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			l := 0
+			for p+l < end && (expr[p+l] >= 'a' && expr[p+l] <= 'z' || expr[p+l] >= 'A' && expr[p+l] <= 'Z') {
+				l++
+			}
+			word := strings.ToLower(expr[p : p+l])
+			p += l
+			op, ok := exprWords[word]
+			if !ok {
+				return "", exprError("Unrecognized word \"" + word + "\".")
+			}
+			switch {
+			case op == exprPi:
+				if expecting != "expression" {
+					return "", exprError("Unexpected number.")
+				}
+				operands = append(operands, math.Pi)
+				expecting = "operator"
+				continue
+			case op == exprExponent && expecting == "expression":
+				// e as a constant
+				operands = append(operands, math.E)
+				expecting = "operator"
+				continue
+			case isUnaryExprOp(op):
+				if expecting != "expression" {
+					return "", exprError("Unexpected " + word + " operator.")
+				}
+				operators = append(operators, op)
+				continue
+			}
+			if expecting != "operator" {
+				return "", exprError("Unexpected " + word + " operator.")
+			}
+			if err := pushOp(op); err != nil {
+				return "", err
+			}
+			expecting = "expression"
+			continue
+		case c == '+' || c == '-' || r == '−':
+			if r == '−' {
+				p += rl
+			} else {
+				p++
+			}
+			if expecting == "expression" {
+				if c == '+' {
+					operators = append(operators, exprPositive)
+				} else {
+					operators = append(operators, exprNegative)
+				}
+				continue
+			}
+			op := exprMinus
+			if c == '+' {
+				op = exprPlus
+			}
+			if err := pushOp(op); err != nil {
+				return "", err
+			}
+			expecting = "expression"
+			continue
+		case c == '(':
+			if expecting == "operator" {
+				return "", exprError("Unexpected ( operator.")
+			}
+			operators = append(operators, exprOpen)
+			p++
+			continue
+		case c == ')':
+			for len(operators) > 0 && operators[len(operators)-1] != exprOpen {
+				if err := doOp(operators[len(operators)-1]); err != nil {
+					return "", err
+				}
+				operators = operators[:len(operators)-1]
+			}
+			if len(operators) == 0 {
+				return "", exprError("Unexpected closing bracket.")
+			}
+			operators = operators[:len(operators)-1]
+			expecting = "operator"
+			p++
+			continue
+		}
+
+		// punctuation operators
+		var op int
+		name := ""
+		switch {
+		case strings.HasPrefix(expr[p:], "<="):
+			op, name = exprLessEq, "<="
+		case strings.HasPrefix(expr[p:], ">="):
+			op, name = exprGreaterEq, ">="
+		case strings.HasPrefix(expr[p:], "<>"):
+			op, name = exprNotEq, "<>"
+		case strings.HasPrefix(expr[p:], "!="):
+			op, name = exprNotEq, "!="
+		case c == '*':
+			op, name = exprTimes, "*"
+		case c == '/':
+			op, name = exprDivide, "/"
+		case c == '^':
+			op, name = exprPow, "^"
+		case c == '=':
+			op, name = exprEquality, "="
+		case c == '<':
+			op, name = exprLess, "<"
+		case c == '>':
+			op, name = exprGreater, ">"
+		default:
+			return "", exprError("Unrecognized punctuation character \"" + string(r) + "\".")
+		}
+		p += len(name)
+		if expecting == "expression" {
+			return "", exprError("Unexpected " + name + " operator.")
+		}
+		if err := pushOp(op); err != nil {
+			return "", err
+		}
+		expecting = "expression"
+	}
+
+	for len(operators) > 0 {
+		op := operators[len(operators)-1]
+		operators = operators[:len(operators)-1]
+		if op == exprOpen {
+			return "", exprError("Unclosed bracket.")
+		}
+		if err := doOp(op); err != nil {
+			return "", err
+		}
+	}
+	if len(operands) == 0 {
+		return "", nil
+	}
+	out := make([]string, 0, len(operands))
+	for _, v := range operands {
+		out = append(out, formatPHPFloat(v))
+	}
+	return strings.Join(out, "<br />\n"), nil
+}
+
+func exprDoOperation(op int, stack []float64) ([]float64, error) {
+	n := 2
+	if isUnaryExprOp(op) {
+		n = 1
+	}
+	if len(stack) < n {
+		return nil, exprError("Missing operand for " + exprNames[op] + ".")
+	}
+	if n == 1 {
+		arg := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		var v float64
+		switch op {
+		case exprNegative:
+			v = -arg
+		case exprPositive:
+			v = arg
+		case exprNot:
+			v = boolFloat(arg == 0)
+		case exprSine:
+			v = math.Sin(arg)
+		case exprCosine:
+			v = math.Cos(arg)
+		case exprTangens:
+			v = math.Tan(arg)
+		case exprArcSine:
+			if arg < -1 || arg > 1 {
+				return nil, errors.New("Invalid argument for asin: < -1 or > 1.")
+			}
+			v = math.Asin(arg)
+		case exprArcCos:
+			if arg < -1 || arg > 1 {
+				return nil, errors.New("Invalid argument for acos: < -1 or > 1.")
+			}
+			v = math.Acos(arg)
+		case exprArcTan:
+			v = math.Atan(arg)
+		case exprExp:
+			v = math.Exp(arg)
+		case exprLn:
+			if arg <= 0 {
+				return nil, errors.New("Invalid argument for ln: <= 0.")
+			}
+			v = math.Log(arg)
+		case exprAbs:
+			v = math.Abs(arg)
+		case exprFloor:
+			v = math.Floor(arg)
+		case exprTrunc:
+			v = math.Trunc(arg)
+		case exprCeil:
+			v = math.Ceil(arg)
+		case exprSqrt:
+			v = math.Sqrt(arg)
+			if math.IsNaN(v) {
+				return nil, errors.New("In sqrt: result is not a number.")
+			}
+		}
+		return append(stack, v), nil
+	}
+	left, right := stack[len(stack)-2], stack[len(stack)-1]
+	stack = stack[:len(stack)-2]
+	var v float64
+	switch op {
+	case exprExponent:
+		v = left * math.Pow(10, right)
+	case exprPow:
+		v = math.Pow(left, right)
+		if math.IsNaN(v) {
+			return nil, errors.New("In ^: result is not a number.")
+		}
+	case exprTimes:
+		v = left * right
+	case exprDivide:
+		if right == 0 {
+			return nil, errors.New("Division by zero.")
+		}
+		v = left / right
+	case exprMod:
+		l, r := int64(left), int64(right)
+		if r == 0 {
+			return nil, errors.New("Division by zero.")
+		}
+		v = float64(l % r)
+	case exprFMod:
+		if right == 0 {
+			return nil, errors.New("Division by zero.")
+		}
+		v = math.Mod(left, right)
+	case exprPlus:
+		v = left + right
+	case exprMinus:
+		v = left - right
+	case exprRound:
+		v = phpRound(left, int(right))
+	case exprEquality:
+		v = boolFloat(left == right)
+	case exprNotEq:
+		v = boolFloat(left != right)
+	case exprLess:
+		v = boolFloat(left < right)
+	case exprGreater:
+		v = boolFloat(left > right)
+	case exprLessEq:
+		v = boolFloat(left <= right)
+	case exprGreaterEq:
+		v = boolFloat(left >= right)
+	case exprAnd:
+		v = boolFloat(left != 0 && right != 0)
+	case exprOr:
+		v = boolFloat(left != 0 || right != 0)
+	}
+	return append(stack, v), nil
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// phpFloatVal converts the longest numeric prefix of s, like PHP's floatval.
+func phpFloatVal(s string) float64 {
+	for l := len(s); l > 0; l-- {
+		if v, err := strconv.ParseFloat(s[:l], 64); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// phpRound rounds half away from zero to the given number of decimals.
+func phpRound(v float64, precision int) float64 {
+	p := math.Pow(10, float64(precision))
+	if math.IsInf(p, 0) || p == 0 {
+		return v
+	}
+	return math.Round(v*p) / p
+}
+
+// formatPHPFloat formats v the way PHP converts floats to strings.
+func formatPHPFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NAN"
+	case math.IsInf(v, 1):
+		return "INF"
+	case math.IsInf(v, -1):
+		return "-INF"
+	case v == 0:
+		return "0"
+	}
+	s := strconv.FormatFloat(v, 'G', 14, 64)
+	i := strings.IndexByte(s, 'E')
+	if i < 0 {
+		return s
+	}
+	mant, exp := s[:i], s[i+1:]
+	if !strings.Contains(mant, ".") {
+		mant += ".0"
+	}
+	sign := exp[:1]
+	exp = strings.TrimLeft(exp[1:], "0")
+	return mant + "E" + sign + exp
+}
@@ -23,6 +23,7 @@ import (
 	"html"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // var Debug bool = false
@@ -38,22 +39,114 @@ type Article struct {
 	Media        []WikiLink
 	Tokens       []*Token
 	//	OldTokens    []*Token
-	Root      *ParseNode
-	Parsed    bool
-	Text      string
-	TextLinks []FullWikiLink
-	Templates []*Template
+	Root       *ParseNode
+	Parsed     bool
+	Text       string
+	TextLinks  []FullWikiLink
+	Templates  []*Template
+	Categories []Category
+	Context    *PageContext
+	// links to the same page in other languages, e.g. [[fr:Paris]]
+	LanguageLinks []WikiLink
+	// inline links to pages of other wikis, e.g. [[wikt:word]]
+	InterwikiLinks []WikiLink
+	// ISBN, RFC and PMID magic links
+	Identifiers []Identifier
+	// options of the file links in Media, in the same order
+	MediaOptions []*MediaOptions
+	// footnotes defined by <ref> tags, in order of first use
+	References []*Reference
 
 	// unexported fields
 	gt                   bool
 	text                 *bytes.Buffer
 	nchar                int
 	innerParseErrorCount int
+	inLink               int
+	defaultSort          string
+	refUses              map[*ParseNode]refUse
+	nodeTemplates        map[*ParseNode]*Template
+	nodeMedia            map[*ParseNode]*MediaOptions
 }
+
+// PageContext holds the information about the page and the wiki that is not
+// part of the page text, used to expand variables such as {{CURRENTYEAR}} or
+// {{REVISIONID}}. Setting Now makes the expansion deterministic, e.g. to the
+// date of a dump.
+type PageContext struct {
+	Now               time.Time      // the current time, time.Now() if zero
+	Location          *time.Location // time zone of the LOCAL* variables, UTC if nil
+	RevisionId        int64
+	RevisionTimestamp time.Time
+	RevisionUser      string
+	PageId            int64
+	SiteName          string          // "Wikipedia" if empty
+	Server            string          // "//en.wikipedia.org" if empty
+	ArticlePath       string          // "/wiki/$1" if empty
+	ScriptPath        string          // "/w" if empty
+	UploadPath        string          // base URL of the files, DefaultUploadPath if empty
+	ContentLanguage   string          // "en" if empty
+	Namespaces        *NamespaceTable // StandardNamespaceTable if nil
+	Interwikis        Interwikis      // StandardInterwikis if nil
+	URLProtocols      []string        // protocols of external links, DefaultURLProtocols if nil
+	// localized names of the options of file links, see DefaultMediaKeywords
+	MediaKeywords map[string][]string
+	// names of the infobox templates, DefaultInfoboxPatterns if nil
+	InfoboxPatterns []string
+}
+
+// withDefaults returns a copy of pc with the empty fields set to their
+// default values.
+func (pc *PageContext) withDefaults() *PageContext {
+	out := PageContext{}
+	if pc != nil {
+		out = *pc
+	}
+	if out.Now.IsZero() {
+		out.Now = time.Now()
+	}
+	if out.Location == nil {
+		out.Location = time.UTC
+	}
+	if out.Namespaces == nil {
+		out.Namespaces = StandardNamespaceTable
+	}
+	if out.Interwikis == nil {
+		out.Interwikis = StandardInterwikis
+	}
+	if out.URLProtocols == nil {
+		out.URLProtocols = DefaultURLProtocols
+	}
+	if out.InfoboxPatterns == nil {
+		out.InfoboxPatterns = DefaultInfoboxPatterns
+	}
+	if len(out.SiteName) == 0 {
+		out.SiteName = "Wikipedia"
+	}
+	if len(out.Server) == 0 {
+		out.Server = "//en.wikipedia.org"
+	}
+	if len(out.ArticlePath) == 0 {
+		out.ArticlePath = "/wiki/$1"
+	}
+	if len(out.ScriptPath) == 0 {
+		out.ScriptPath = "/w"
+	}
+	if len(out.UploadPath) == 0 {
+		out.UploadPath = DefaultUploadPath
+	}
+	if len(out.ContentLanguage) == 0 {
+		out.ContentLanguage = "en"
+	}
+	return &out
+}
+
 type WikiLink struct {
-	Namespace string
-	PageName  string
-	Anchor    string
+	Interwiki   string // prefix of the wiki of the page, empty for local pages
+	Namespace   string
+	NamespaceId int // id of the namespace in the Namespaces table, 0 if unknown
+	PageName    string
+	Anchor      string
 }
 type FullWikiLink struct {
 	Link  WikiLink
@@ -74,6 +167,11 @@ func NewArticle(title, text string) (*Article, error) {
 	a.Media = make([]WikiLink, 0, 16)
 	a.TextLinks = make([]FullWikiLink, 0, 16)
 	a.ExtLinks = make([]string, 0, 16)
+	a.Categories = make([]Category, 0, 4)
+	a.LanguageLinks = make([]WikiLink, 0, 4)
+	a.InterwikiLinks = make([]WikiLink, 0, 4)
+	a.Identifiers = make([]Identifier, 0, 4)
+	a.MediaOptions = make([]*MediaOptions, 0, 16)
 	return a, nil
 }
 
@@ -99,6 +197,10 @@ func (a *Article) GetExternalLinks() []string {
 	return a.ExtLinks
 }
 
+func (a *Article) GetCategories() []Category {
+	return a.Categories
+}
+
 func (a *Article) GetMedia() []WikiLink {
 	return a.Media
 }
@@ -125,6 +227,20 @@ func WikiCanonicalFormNamespace(l string, defaultNamespace string) WikiLink {
 }
 
 func (namespaces Namespaces) WikiCanonicalFormNamespaceEsc(l string, defaultNamespace string, unescape bool) WikiLink {
+	return wikiCanonicalForm(namespaces.lookup, l, defaultNamespace, unescape)
+}
+
+func (nt *NamespaceTable) WikiCanonicalFormNamespaceEsc(l string, defaultNamespace string, unescape bool) WikiLink {
+	return wikiCanonicalForm(nt.ByName, l, defaultNamespace, unescape)
+}
+
+// wikiCanonicalForm returns the canonical form of link l, looking up the
+// namespaces by name with lookup.
+func wikiCanonicalForm(lookup func(string) (*Namespace, bool), l string, defaultNamespace string, unescape bool) WikiLink {
+	if t := strings.TrimSpace(l); strings.HasPrefix(t, ":") {
+		// a leading colon only forces the link to be inline
+		l = t[1:]
+	}
 	hpos := strings.IndexRune(l, '#')
 	anchor := ""
 	if hpos >= 0 {
@@ -138,39 +254,53 @@ func (namespaces Namespaces) WikiCanonicalFormNamespaceEsc(l string, defaultName
 		if unescape {
 			cns = html.UnescapeString(cns)
 		}
-		ns, ok := namespaces[strings.ToLower(cns)]
+		ns, ok := lookup(cns)
 		switch {
 		case ok && len(cns) > 0:
-			namespace = ns //strings.ToUpper(cns[0:1]) + strings.ToLower(cns[1:])
+			namespace = ns.Name //strings.ToUpper(cns[0:1]) + strings.ToLower(cns[1:])
 		case ok:
 			namespace = ""
 		default:
 			i = -1
 		}
 	}
+	nsid := 0
+	caseSensitive := false
+	if ns, ok := lookup(namespace); ok {
+		namespace = ns.Name
+		nsid = ns.Id
+		caseSensitive = ns.CaseSensitive
+	}
 	article := strings.TrimSpace(canoReSpaces.ReplaceAllString(l[i+1:], " "))
 	anchor = canoReSpaces.ReplaceAllString(anchor, " ")
 	if unescape {
 		article = html.UnescapeString(article)
 		anchor = html.UnescapeString(anchor)
 	}
-	if len(article) > 0 {
-		article = strings.ToUpper(article[0:1]) + article[1:]
+	if !caseSensitive {
+		article = ucfirst(article)
 	}
-	return WikiLink{Namespace: namespace, PageName: article, Anchor: anchor}
+	return WikiLink{Namespace: namespace, NamespaceId: nsid, PageName: article, Anchor: anchor}
 }
 
 func (wl *WikiLink) FullPagename() string {
+	iw := ""
+	if len(wl.Interwiki) != 0 {
+		iw = wl.Interwiki + ":"
+	}
 	if len(wl.Namespace) == 0 {
-		return wl.PageName
+		return iw + wl.PageName
 	}
-	return wl.Namespace + ":" + wl.PageName
+	return iw + wl.Namespace + ":" + wl.PageName
 }
 
 func (wl *WikiLink) FullPagenameAnchor() string {
 	ns := ""
+	if len(wl.Interwiki) != 0 {
+		ns = wl.Interwiki + ":"
+	}
 	if len(wl.Namespace) != 0 {
-		ns = wl.Namespace + ":"
+		ns += wl.Namespace + ":"
 	}
 	an := ""
 	if len(wl.Anchor) != 0 {
@@ -183,6 +313,16 @@ func (wl *WikiLink) IsImplicitSelfLink() bool {
 	return len(wl.PageName) == 0
 }
 
+// IsInterwiki tells if the link points to a page of another wiki.
+func (wl *WikiLink) IsInterwiki() bool {
+	return len(wl.Interwiki) != 0
+}
+
+// IsTalkPage tells if the link points to a talk namespace.
+func (wl *WikiLink) IsTalkPage() bool {
+	return wl.NamespaceId > 0 && wl.NamespaceId%2 == 1
+}
+
 func (wl *WikiLink) HasAnchor() bool {
 	return len(wl.Anchor) != 0
 }
@@ -191,41 +331,6 @@ func (wl *WikiLink) GetAnchor() string {
 	return wl.Anchor
 }
 
-type Namespaces map[string]string
-
-var StandardNamespaces Namespaces = map[string]string{
-	"media":                  "Media",
-	"special":                "Special",
-	"talk":                   "Talk",
-	"user":                   "User",
-	"user talk":              "User talk",
-	"wikipedia":              "Wikipedia",
-	"wikipedia talk":         "Wikipedia talk",
-	"file":                   "File",
-	"file talk":              "File talk",
-	"mediawiki":              "MediaWiki",
-	"mediawiki talk":         "MediaWiki talk",
-	"template":               "Template",
-	"template talk":          "Template talk",
-	"help":                   "Help",
-	"help talk":              "Help talk",
-	"category":               "Category",
-	"category talk":          "Category talk",
-	"portal":                 "Portal",
-	"portal talk":            "Portal talk",
-	"book":                   "Book",
-	"book talk":              "Book talk",
-	"draft":                  "Draft",
-	"draft talk":             "Draft talk",
-	"education program":      "Education Program",
-	"education program talk": "Education Program talk",
-	"timedtext":              "TimedText",
-	"timedtext talk":         "TimedText talk",
-	"module":                 "Module",
-	"module talk":            "Module talk",
-	"topic":                  "Topic",
-}
-
 type DummyPageGetter struct{}
 
 func (g *DummyPageGetter) Get(wl WikiLink) (string, error) {
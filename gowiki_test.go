@@ -17,10 +17,13 @@ limitations under the License.
 package gowiki
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	//	"os"
-	//	"strings"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseArticle(t *testing.T) {
@@ -44,3 +47,994 @@ func TestWikiCanonicalFormNamespaceEsc(t *testing.T) {
 		t.Error("Error: wikilink not parsed correctly", wl)
 	}
 }
+
+func TestParseTable(t *testing.T) {
+	mw := "{| class=\"wikitable\"\n|+ Caption\n! H1 !! style=\"x\" | H2\n|-\n| [[Foo|foo]] || b\n|}"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Root.Nodes) == 0 || a.Root.Nodes[0].NSubType != "table" {
+		t.Fatal("Error: table not parsed")
+	}
+	table := a.Root.Nodes[0]
+	if table.Contents != `class="wikitable"` || len(table.Nodes) != 3 {
+		t.Error("Error: wrong table structure", table.Contents, len(table.Nodes))
+	}
+	if len(table.Nodes) == 3 && (table.Nodes[1].Nodes[1].NSubType != "th" || table.Nodes[1].Nodes[1].Contents != `style="x"`) {
+		t.Error("Error: header cell attributes not parsed")
+	}
+	if len(a.Links) != 1 || a.Links[0].PageName != "Foo" {
+		t.Error("Error: links in table not found", a.Links)
+	}
+}
+
+func TestGetTables(t *testing.T) {
+	mw := "{|\n|+ Results\n! rowspan=2 | Party !! colspan=\"2\" | Votes\n|-\n! # !! %\n|-\n| [[A]] || 10 || 50\n|}"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	tables := a.GetTables()
+	if len(tables) != 1 {
+		t.Fatal("Error: wrong number of tables", len(tables))
+	}
+	tb := tables[0]
+	if tb.Caption != "Results" || tb.HeaderRows != 2 || len(tb.Rows) != 3 || len(tb.Rows[0]) != 3 {
+		t.Fatal("Error: wrong table layout", tb.Caption, tb.HeaderRows, len(tb.Rows))
+	}
+	if tb.Rows[1][0].Text != "Party" || tb.Rows[0][2].Text != "Votes" || tb.Rows[1][1].Text != "#" {
+		t.Error("Error: spans not expanded")
+	}
+	if c := tb.Rows[2][0]; len(c.Links) != 1 || c.Links[0].PageName != "A" {
+		t.Error("Error: cell links not found")
+	}
+}
+
+func TestParseList(t *testing.T) {
+	mw := "* a\n*# b\n; term : def\nend"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	ul := a.Root.Nodes[0]
+	if ul.NSubType != "ul" || len(ul.Nodes) != 1 || len(ul.Nodes[0].Nodes) != 2 || ul.Nodes[0].Nodes[1].NSubType != "ol" {
+		t.Error("Error: nested list not built correctly")
+	}
+	dl := a.Root.Nodes[1]
+	if dl.NSubType != "dl" || len(dl.Nodes) != 2 || dl.Nodes[0].NSubType != "dt" || dl.Nodes[1].NSubType != "dd" {
+		t.Error("Error: definition list not built correctly")
+	}
+	if txt := a.GetText(); txt != "a\nb\nterm\ndef\nend\n" {
+		t.Errorf("Error: wrong text %q", txt)
+	}
+}
+
+type mapPageGetter struct {
+	pages   map[string]string
+	fetched map[string]int
+}
+
+func (g *mapPageGetter) Get(wl WikiLink) (string, error) {
+	if g.fetched == nil {
+		g.fetched = make(map[string]int)
+	}
+	g.fetched[wl.FullPagename()]++
+	return g.pages[wl.FullPagename()], nil
+}
+
+func TestParserFunctions(t *testing.T) {
+	g := &mapPageGetter{pages: map[string]string{"Template:A": "a{{{1|}}}", "Template:B": "b"}}
+	tests := map[string]string{
+		"{{#if: x | {{A|1}} | {{B}}}}":                            "a1\n",
+		"{{#ifeq: 01 | 1 | eq | ne}}":                             "eq\n",
+		"{{#switch: b | a = A | b | c = BC | #default = D}}":      "BC\n",
+		"{{#switch: z | a = A | #default = D}}":                   "D\n",
+		"{{#expr: 10 mod 3 + 2 ^ 3 ^ 2}}":                         "65\n",
+		"{{#expr: 1/3}}":                                          "0.33333333333333\n",
+		"{{#ifexpr: 2 > 1 and not 0 | y | n}}":                    "y\n",
+		"{{#ifexist: Template:A | y | n}}{{#ifexist: C | y | n}}": "yn\n",
+		"{{#iferror: {{#expr: 1/0}} | err | ok}}":                 "err\n",
+	}
+	for mw, expected := range tests {
+		a, err := ParseArticle("Test", mw, g)
+		if err != nil {
+			t.Fatal("Error:", err)
+		}
+		if txt := a.GetText(); txt != expected {
+			t.Errorf("Error: %s rendered as %q, expected %q", mw, txt, expected)
+		}
+	}
+	if g.fetched["Template:B"] != 0 {
+		t.Error("Error: branch not taken was expanded")
+	}
+
+	a, err := ParseArticle("Test", "{{#if:x|k=v|second}}", g)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Templates) != 1 || len(a.Templates[0].Params) != 2 {
+		t.Fatalf("Error: wrong templates %v", a.Templates)
+	}
+	if p := a.Templates[0].Params[1]; p.Name != "1" || p.Value != "second" {
+		t.Errorf("Error: wrong positional parameter %#v", p)
+	}
+}
+
+func TestMagicWords(t *testing.T) {
+	mw := "{{PAGENAME}}|{{NAMESPACE}}|{{TALKPAGENAME}}|{{SUBPAGENAME}}|{{lc:ABC}}|{{padleft:7|3}}|{{urlencode:a b|WIKI}}|{{formatnum:1234567.5}}"
+	a, err := ParseArticle("User:Jo/Sub", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := "Jo/Sub|User|User talk:Jo/Sub|Sub|abc|007|a_b|1,234,567.5\n"
+	if txt := a.GetText(); txt != expected {
+		t.Errorf("Error: magic words rendered as %q, expected %q", txt, expected)
+	}
+}
+
+func TestPageContext(t *testing.T) {
+	pc := &PageContext{
+		Now:               time.Date(2016, 3, 1, 14, 5, 9, 0, time.UTC),
+		RevisionId:        42,
+		RevisionTimestamp: time.Date(2015, 12, 31, 23, 0, 0, 0, time.UTC),
+		RevisionUser:      "Bob",
+	}
+	mw := "{{CURRENTYEAR}}|{{CURRENTMONTHNAME}}|{{CURRENTTIMESTAMP}}|{{REVISIONID}}|{{REVISIONYEAR}}|{{REVISIONUSER}}|{{SITENAME}}"
+	a, err := ParseArticleWithContext("Test", mw, &DummyPageGetter{}, pc)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := "2016|March|20160301140509|42|2015|Bob|Wikipedia\n"
+	if txt := a.GetText(); txt != expected {
+		t.Errorf("Error: variables rendered as %q, expected %q", txt, expected)
+	}
+}
+
+func TestTimeFunction(t *testing.T) {
+	pc := &PageContext{Now: time.Date(2016, 3, 1, 14, 5, 9, 0, time.UTC)}
+	tests := map[string]string{
+		"{{#time: j F Y | 2001-09-11}}":             "11 September 2001",
+		"{{#time: Y-m-d | 1959}}":                   "1959-03-01",
+		"{{#time: Y-m-d H:i | +1 day}}":             "2016-03-02 14:05",
+		"{{#time: Y-m-d | last monday}}":            "2016-02-29",
+		"{{#time: Y-m-d | last day of next month}}": "2016-04-30",
+		`{{#time: xg "of" xrY xx | 2012-02-29}}`:    "February of MMXII x",
+		"{{#time: xjY xmn | 2012-02-29}}":           "2012 2",
+	}
+	for mw, expected := range tests {
+		a, err := ParseArticleWithContext("Test", mw, &DummyPageGetter{}, pc)
+		if err != nil {
+			t.Fatal("Error:", err)
+		}
+		if txt := a.GetText(); txt != expected+"\n" {
+			t.Errorf("Error: %s rendered as %q, expected %q", mw, txt, expected)
+		}
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	mw := "== Intro ==\n'''Go''' [[Foo bar#Sec|foo]] <span onclick=\"x()\" class=\"c\">a &lt; b</span> [http://x.org/?a=1&b=2]<ref>Note</ref>\n<references/>"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	var b bytes.Buffer
+	opts := &HTMLOptions{LinkURL: func(wl WikiLink) string { return "/page/" + wl.FullPagename() }}
+	if err := a.RenderHTML(&b, opts); err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := `<h2 id="Intro"> Intro </h2>
+<p><b>Go</b> <a href="/page/Foo bar" title="Foo bar">foo</a> <span class="c">a &lt; b</span> <a rel="nofollow" class="external" href="http://x.org/?a=1&amp;b=2">[1]</a><sup id="cite_ref-1" class="reference"><a href="#cite_note-1">[1]</a></sup>
+</p>
+<ol class="references"><li id="cite_note-1"><a href="#cite_ref-1">^</a> Note</li></ol>
+`
+	if html := b.String(); html != expected {
+		t.Errorf("Error: html rendered as\n%s\nexpected\n%s", html, expected)
+	}
+
+	a, err = ParseArticle("Test", " indented\n text", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	b.Reset()
+	if err := a.RenderHTML(&b, opts); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if html := b.String(); !strings.Contains(html, "<pre>indented\ntext</pre>") {
+		t.Errorf("Error: indented lines rendered as\n%s", html)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	mw := "== Intro ==\n'''Go''' ''is'' [[Foo bar|foo_bar]]<ref>Note</ref>\n<nowiki># 1*2</nowiki>\n* a\n** b\n{|\n! h1 !! h2\n|-\n| x || a [[B|b]]\n|}\n<pre>code</pre>"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	var b bytes.Buffer
+	opts := &MarkdownOptions{LinkURL: func(wl WikiLink) string { return "wiki:" + wl.FullPagename() }}
+	if err := a.RenderMarkdown(&b, opts); err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := "## Intro\n\n**Go** *is* [foo\\_bar](wiki:Foo%20bar)[^1]\n\\# 1\\*2\n\n- a\n  - b\n\n| h1 | h2 |\n| --- | --- |\n| x | a [b](wiki:B) |\n\n```\ncode\n```\n\n[^1]: Note\n"
+	if md := b.String(); md != expected {
+		t.Errorf("Error: markdown rendered as %q, expected %q", md, expected)
+	}
+
+	a, err = ParseArticle("Test", "{|\n|+ T\n! colspan=2 | h\n|-\n| rowspan=2 | a || b\n|-\n| c\n|}", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	b.Reset()
+	if err := a.RenderMarkdown(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected = "T\n\n| h | h |\n| --- | --- |\n| a | b |\n| a | c |\n"
+	if md := b.String(); md != expected {
+		t.Errorf("Error: markdown rendered as %q, expected %q", md, expected)
+	}
+}
+
+const testSiteinfoXML = `<siteinfo>
+    <sitename>Wiktionary</sitename>
+    <case>case-sensitive</case>
+    <namespaces>
+      <namespace key="-2" case="case-sensitive">Medium</namespace>
+      <namespace key="0" case="case-sensitive" />
+      <namespace key="1" case="case-sensitive">Diskussion</namespace>
+      <namespace key="6" case="first-letter">Datei</namespace>
+      <namespace key="7" case="first-letter">Datei Diskussion</namespace>
+      <namespace key="14" case="case-sensitive">Kategorie</namespace>
+    </namespaces>
+  </siteinfo>`
+
+const testSiteinfoJSON = `{"batchcomplete": "", "query": {
+	"namespaces": {
+		"0": {"id": 0, "case": "first-letter", "*": "", "content": ""},
+		"6": {"id": 6, "case": "first-letter", "canonical": "File", "*": "Fichier"},
+		"100": {"id": 100, "case": "first-letter", "canonical": "Portal", "subpages": "", "content": "", "*": "Portail"}
+	},
+	"namespacealiases": [{"id": 6, "*": "Image"}, {"id": 100, "*": "Portal"}, {"id": 6, "*": "Dossier"}]
+}}`
+
+func TestNamespaces(t *testing.T) {
+	nss, err := NewNamespaceTableFromXML(strings.NewReader(testSiteinfoXML))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	tests := map[string]string{
+		"image:Foo.jpg":      "Datei:Foo.jpg",
+		"bild:Foo.jpg":       "bild:Foo.jpg",
+		"File talk:foo":      "Datei Diskussion:Foo",
+		"Category:abc":       "Kategorie:abc",
+		"talk:abc":           "Diskussion:abc",
+		"abc":                "abc",
+		"Wikipedia:Mainpage": "Wikipedia:Mainpage",
+	}
+	for in, expected := range tests {
+		wl := nss.WikiCanonicalFormNamespaceEsc(in, "", true)
+		if wl.FullPagename() != expected {
+			t.Errorf("Error: %s canonicalized as %s, expected %s", in, wl.FullPagename(), expected)
+		}
+	}
+	if ns := nss.ById(6); ns == nil || ns.Name != "Datei" || ns.CanonicalName != "File" || ns.Subpages {
+		t.Errorf("Error: wrong File namespace %#v", ns)
+	}
+
+	nss, err = NewNamespaceTableFromJSON(strings.NewReader(testSiteinfoJSON))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if ns, _ := nss.ByName("dossier"); ns == nil || ns.Id != 6 || ns.Name != "Fichier" {
+		t.Errorf("Error: alias Dossier resolved to %#v", ns)
+	}
+	if ns, _ := nss.ByName("portal"); ns == nil || ns.Name != "Portail" || !ns.Content || !ns.Subpages {
+		t.Errorf("Error: wrong Portal namespace %#v", ns)
+	}
+	a, err := ParseArticleWithContext("Test", "[[Image:x.png|thumb|légende]] [[Portal:Y]]", &DummyPageGetter{}, &PageContext{Namespaces: nss})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Media) != 1 || a.Media[0].FullPagename() != "Fichier:X.png" {
+		t.Errorf("Error: wrong media %v", a.Media)
+	}
+	if len(a.Links) != 1 || a.Links[0].FullPagename() != "Portail:Y" {
+		t.Errorf("Error: wrong links %v", a.Links)
+	}
+
+	if StandardNamespaces["wikipedia talk"] != "Wikipedia talk" || StandardNamespaces["image"] != "File" {
+		t.Errorf("Error: wrong standard namespace names")
+	}
+	old := Namespaces{"file": "File", "bild": "File", "talk": "Talk", "custom": "Custom"}
+	for in, expected := range map[string]string{"Bild:a.jpg": "File:A.jpg", "custom:x": "Custom:X", "Help:x": "Help:x"} {
+		if wl := old.WikiCanonicalFormNamespaceEsc(in, "", true); wl.FullPagename() != expected {
+			t.Errorf("Error: %s canonicalized as %s, expected %s", in, wl.FullPagename(), expected)
+		}
+	}
+	nss = old.Table()
+	if ns := nss.ById(6); ns == nil || ns.Name != "File" || ns.Subpages {
+		t.Errorf("Error: wrong File namespace %#v", ns)
+	}
+	if ns, _ := nss.ByName("bild"); ns == nil || ns.Id != 6 {
+		t.Errorf("Error: alias Bild resolved to %#v", ns)
+	}
+	if ns, _ := nss.ByName("custom"); ns == nil || ns.Id != 0 || nss.ById(0).Name != "" {
+		t.Errorf("Error: wrong custom namespace %#v", ns)
+	}
+	if _, ok := nss.TalkPage(WikiLink{Namespace: "Custom", PageName: "X"}); ok {
+		t.Errorf("Error: talk page of a namespace without id")
+	}
+}
+
+func TestTalkPages(t *testing.T) {
+	tests := map[string][2]string{
+		"X":                  {"Talk:X", "X"},
+		"Talk:X":             {"Talk:X", "X"},
+		"User:Y":             {"User talk:Y", "User:Y"},
+		"user_talk:Y":        {"User talk:Y", "User:Y"},
+		"Wikipedia talk:Z/a": {"Wikipedia talk:Z/a", "Wikipedia:Z/a"},
+		"Special:Random":     {"", "Special:Random"},
+	}
+	for in, expected := range tests {
+		wl := WikiCanonicalForm(in)
+		talk, ok := StandardNamespaceTable.TalkPage(wl)
+		if ok != (expected[0] != "") || ok && talk.FullPagename() != expected[0] {
+			t.Errorf("Error: talk page of %s is %s, expected %s", in, talk.FullPagename(), expected[0])
+		}
+		if ok && !talk.IsTalkPage() {
+			t.Errorf("Error: %s is not a talk page", talk.FullPagename())
+		}
+		subject, _ := StandardNamespaceTable.SubjectPage(wl)
+		if subject.FullPagename() != expected[1] {
+			t.Errorf("Error: subject page of %s is %s, expected %s", in, subject.FullPagename(), expected[1])
+		}
+	}
+	if wl := WikiCanonicalForm("User talk:Y"); wl.NamespaceId != 3 {
+		t.Errorf("Error: namespace id of %s is %d, expected 3", wl.FullPagename(), wl.NamespaceId)
+	}
+
+	nss, err := NewNamespaceTableFromXML(strings.NewReader(testSiteinfoXML))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	talk, _ := nss.TalkPage(nss.WikiCanonicalFormNamespaceEsc("File:a.jpg", "", true))
+	if talk.FullPagename() != "Datei Diskussion:A.jpg" || talk.NamespaceId != 7 {
+		t.Errorf("Error: localized talk page is %s", talk.FullPagename())
+	}
+	a, err := ParseArticleWithContext("Datei:A.jpg", "{{TALKPAGENAME}}|{{SUBJECTSPACE:Diskussion:x}}|{{NAMESPACENUMBER}}", &DummyPageGetter{}, &PageContext{Namespaces: nss})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if txt := a.GetText(); txt != "Datei Diskussion:A.jpg||6\n" {
+		t.Errorf("Error: localized title magic words rendered as %q", txt)
+	}
+}
+
+func TestParseTitle(t *testing.T) {
+	valid := map[string]string{
+		"élan":        "Élan",
+		"ñandú":       "Ñandú",
+		"user:ǆungla": "User:Ǆungla",
+		"Talk:a/b":    "Talk:A/b",
+		"A&amp;B":     "A&B",
+		"Special:ab":  "Special:Ab",
+	}
+	for in, expected := range valid {
+		wl, err := ParseTitle(in)
+		if err != nil || wl.FullPagename() != expected {
+			t.Errorf("Error: %s parsed as %s (%v), expected %s", in, wl.FullPagename(), err, expected)
+		}
+	}
+	invalid := map[string]string{
+		"":                       TitleEmpty,
+		"Talk:":                  TitleEmpty,
+		"a<b":                    TitleIllegalCharacters,
+		"a[b]":                   TitleIllegalCharacters,
+		"a%41":                   TitleIllegalCharacters,
+		"a&amp;amp;b":            TitleIllegalCharacters,
+		"../a":                   TitleRelative,
+		"a/./b":                  TitleRelative,
+		"a~~~":                   TitleMagicTilde,
+		"Talk::a":                TitleLeadingColon,
+		"Talk:File:a":            TitleTalkNamespace,
+		strings.Repeat("é", 128): TitleTooLong,
+	}
+	for in, reason := range invalid {
+		_, err := ParseTitle(in)
+		if te, ok := err.(*InvalidTitleError); !ok || te.Reason != reason {
+			t.Errorf("Error: %q gave %v, expected %s", in, err, reason)
+		}
+	}
+
+	nss, err := NewNamespaceTableFromXML(strings.NewReader(testSiteinfoXML))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if wl, _ := nss.ParseTitle("élan"); wl.PageName != "élan" {
+		t.Errorf("Error: élan capitalized in a case sensitive namespace")
+	}
+	if wl, _ := nss.ParseTitle("Datei:élan.jpg"); wl.PageName != "Élan.jpg" {
+		t.Errorf("Error: élan.jpg not capitalized in a first-letter namespace")
+	}
+}
+
+func TestCategories(t *testing.T) {
+	mw := "A [[:Category:Foo]] b.\n[[Category:Bar|Key]]\n[[category:baz]]{{DEFAULTSORT:Smith, John}}"
+	a, err := ParseArticle("John Smith", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if txt := a.GetText(); txt != "A Category:Foo b.\n\n\n" {
+		t.Errorf("Error: text is %q", txt)
+	}
+	if len(a.Links) != 1 || a.Links[0].FullPagename() != "Category:Foo" {
+		t.Errorf("Error: wrong links %v", a.Links)
+	}
+	expected := []Category{
+		{Link: WikiLink{Namespace: "Category", NamespaceId: 14, PageName: "Bar"}, Name: "Bar", SortKey: "Key"},
+		{Link: WikiLink{Namespace: "Category", NamespaceId: 14, PageName: "Baz"}, Name: "Baz", SortKey: "Smith, John"},
+	}
+	if len(a.Categories) != len(expected) {
+		t.Fatalf("Error: wrong categories %v", a.Categories)
+	}
+	for i := range expected {
+		if a.Categories[i] != expected[i] {
+			t.Errorf("Error: category %v, expected %v", a.Categories[i], expected[i])
+		}
+	}
+
+	a, err = ParseArticle("Talk:Some page", "[[Category:Bar]]", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Categories) != 1 || a.Categories[0].SortKey != "Some page" {
+		t.Errorf("Error: wrong default sort key %v", a.Categories)
+	}
+}
+
+func TestInterwikiLinks(t *testing.T) {
+	mw := "See [[wikt:word|a word]], [[:fr:Paris]] and [[Wikipedia:X]].\n[[fr:Paris]]\n[[DE:Paris#Geschichte]]"
+	a, err := ParseArticle("Paris", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if txt := a.GetText(); txt != "See a word, fr:Paris and Wikipedia:X.\n\n\n" {
+		t.Errorf("Error: text is %q", txt)
+	}
+	if len(a.Links) != 1 || a.Links[0].FullPagename() != "Wikipedia:X" || len(a.GetTextLinks()) != 1 {
+		t.Errorf("Error: wrong links %v", a.Links)
+	}
+	if len(a.LanguageLinks) != 2 || a.LanguageLinks[0].FullPagename() != "fr:Paris" ||
+		a.LanguageLinks[1].FullPagenameAnchor() != "de:Paris#Geschichte" {
+		t.Errorf("Error: wrong language links %v", a.LanguageLinks)
+	}
+	if len(a.InterwikiLinks) != 2 || a.InterwikiLinks[0].FullPagename() != "wikt:word" || a.InterwikiLinks[1].FullPagename() != "fr:Paris" {
+		t.Errorf("Error: wrong interwiki links %v", a.InterwikiLinks)
+	}
+
+	iws := NewInterwikis([]Interwiki{{Prefix: "Foo", URL: "http://foo.org/$1"}})
+	a, err = ParseArticleWithContext("Test", "[[foo:Bar baz]] [[wikt:word]]", &DummyPageGetter{}, &PageContext{Interwikis: iws})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.InterwikiLinks) != 1 || a.InterwikiLinks[0].FullPagename() != "foo:Bar baz" ||
+		iws["foo"].PageURL(a.InterwikiLinks[0]) != "http://foo.org/Bar_baz" || len(a.Links) != 1 {
+		t.Errorf("Error: wrong links with a custom interwiki table %v %v", a.InterwikiLinks, a.Links)
+	}
+}
+
+func TestFreeLinks(t *testing.T) {
+	mw := "See https://example.org/a_(b), (http://x.org/y). Mail mailto:a@b.c; [[A|http://no.org]] " +
+		"ISBN 978-0-12-345678-9, RFC 2616 and PMID 12345. XISBN 1234567890"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if txt := a.GetText(); txt != strings.Replace(mw, "[[A|http://no.org]]", "http://no.org", 1)+"\n" {
+		t.Errorf("Error: text is %q", txt)
+	}
+	links := []string{"https://example.org/a_(b)", "http://x.org/y", "mailto:a@b.c",
+		"https://datatracker.ietf.org/doc/html/rfc2616", "//www.ncbi.nlm.nih.gov/pubmed/12345?dopt=Abstract"}
+	if len(a.ExtLinks) != len(links) {
+		t.Fatalf("Error: wrong external links %v", a.ExtLinks)
+	}
+	for i := range links {
+		if a.ExtLinks[i] != links[i] {
+			t.Errorf("Error: external link %s, expected %s", a.ExtLinks[i], links[i])
+		}
+	}
+	ids := []Identifier{{"ISBN", "9780123456789"}, {"RFC", "2616"}, {"PMID", "12345"}}
+	if len(a.Identifiers) != len(ids) {
+		t.Fatalf("Error: wrong identifiers %v", a.Identifiers)
+	}
+	for i := range ids {
+		if a.Identifiers[i] != ids[i] {
+			t.Errorf("Error: identifier %v, expected %v", a.Identifiers[i], ids[i])
+		}
+	}
+}
+
+func TestURLProtocols(t *testing.T) {
+	mw := "[https://a.org A] [mailto:x@y.org mail] [irc://irc.libera.chat/x] [news:comp.lang.go] [git://g.org/r.git] [foo://f.org F] git://bare.org/r"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	links := []string{"https://a.org", "mailto:x@y.org", "irc://irc.libera.chat/x", "news:comp.lang.go", "git://g.org/r.git", "git://bare.org/r"}
+	if len(a.ExtLinks) != len(links) {
+		t.Fatalf("Error: wrong external links %v", a.ExtLinks)
+	}
+	for i := range links {
+		if a.ExtLinks[i] != links[i] {
+			t.Errorf("Error: external link %s, expected %s", a.ExtLinks[i], links[i])
+		}
+	}
+
+	a, err = ParseArticleWithContext("Test", mw, &DummyPageGetter{}, &PageContext{URLProtocols: []string{"foo://"}})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.ExtLinks) != 1 || a.ExtLinks[0] != "foo://f.org" {
+		t.Errorf("Error: wrong external links with custom protocols %v", a.ExtLinks)
+	}
+}
+
+func TestMediaOptions(t *testing.T) {
+	mw := "[[File:Cat.jpg|thumb|left|200x100px|upright|alt=A cat|link=Cats|page=2|A [[cat]] sleeping]]\n" +
+		"[[Datei:Hund.jpg|miniatur|hochkant=1.5|links|Ein Hund]]\n[[File:X.png|frameless|300px]]"
+	pc := &PageContext{MediaKeywords: map[string][]string{
+		"thumb":   {"miniatur", "mini"},
+		"left":    {"links"},
+		"upright": {"hochkant", "hochkant=$1"},
+	}}
+	pc.Namespaces = NewNamespaceTable([]Namespace{DefaultNamespace(0, ""), DefaultNamespace(6, "Datei")})
+	a, err := ParseArticleWithContext("Test", mw, &DummyPageGetter{}, pc)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.GetMedia()) != 3 || len(a.MediaOptions) != 3 {
+		t.Fatalf("Error: wrong media %v", a.GetMedia())
+	}
+	o := a.MediaOptions[0]
+	if o.Type != "thumb" || o.Align != "left" || o.Width != 200 || o.Height != 100 || o.Upright != 0.75 ||
+		o.Alt != "A cat" || o.Link != "Cats" || !o.HasLink || o.Page != 2 {
+		t.Errorf("Error: wrong options %#v", o)
+	}
+	if len(collectLinks(o.Caption)) != 1 || !strings.Contains(a.GetText(), "A cat sleeping") {
+		t.Errorf("Error: wrong caption in %q", a.GetText())
+	}
+	o = a.MediaOptions[1]
+	if o.Type != "thumb" || o.Align != "left" || o.Upright != 1.5 || len(o.Caption) == 0 {
+		t.Errorf("Error: wrong localized options %#v", o)
+	}
+	o = a.MediaOptions[2]
+	if o.Type != "frameless" || o.Width != 300 || o.Caption != nil {
+		t.Errorf("Error: wrong options %#v", o)
+	}
+}
+
+func TestGallery(t *testing.T) {
+	mw := "Before\n<gallery caption=\"Pets\">\nFile:Cat.jpg|A ''sleeping'' [[cat]]\nDog.jpg|alt=A dog|thumb\n\nTemplate:Foo|not a file\n</gallery>\nAfter"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.GetMedia()) != 2 || a.Media[0].PageName != "Cat.jpg" || a.Media[1].FullPagename() != "File:Dog.jpg" {
+		t.Fatalf("Error: wrong media %v", a.GetMedia())
+	}
+	if o := a.MediaOptions[1]; o.Alt != "A dog" || o.Type != "" || len(o.Caption) == 0 {
+		t.Errorf("Error: wrong gallery options %#v", o)
+	}
+	var g *ParseNode
+	for _, n := range a.Root.Nodes {
+		if n.NType == "gallery" {
+			g = n
+		}
+	}
+	if g == nil || len(g.Nodes) != 2 || g.Nodes[0].NType != "image" {
+		t.Fatal("Error: missing gallery node")
+	}
+	if len(collectLinks(a.MediaOptions[0].Caption)) != 1 {
+		t.Error("Error: missing link in the gallery caption")
+	}
+	text := a.GetText()
+	if strings.Contains(text, "Cat.jpg") || !strings.Contains(text, "A sleeping cat") {
+		t.Errorf("Error: wrong text %q", text)
+	}
+	var b bytes.Buffer
+	if err := a.RenderHTML(&b, &HTMLOptions{ImageURL: func(wl WikiLink) string { return "/img/" + wl.PageName }}); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if s := b.String(); !strings.Contains(s, `<ul class="gallery"><li class="gallerycaption">Pets</li><li class="gallerybox">`) ||
+		!strings.Contains(s, `<div class="gallerytext">A <i>sleeping</i> `) || !strings.Contains(s, `<img src="/img/Dog.jpg" alt="A dog">`) {
+		t.Errorf("Error: wrong html %q", s)
+	}
+	b.Reset()
+	if err := a.RenderHTML(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if s := b.String(); !strings.Contains(s, `<a href="/wiki/File:Cat.jpg" class="image">A sleeping cat</a>`) {
+		t.Errorf("Error: wrong html without images %q", s)
+	}
+	b.Reset()
+	if err := a.RenderMarkdown(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if s := b.String(); !strings.Contains(s, "Pets\n- [A *sleeping* [cat](/wiki/Cat)](/wiki/File:Cat.jpg)") {
+		t.Errorf("Error: wrong markdown %q", s)
+	}
+
+	g2 := &mapPageGetter{pages: map[string]string{"Template:Pet": "[[{{{1}}}]]"}}
+	a, err = ParseArticle("Test", "<gallery>\nCat.jpg|A {{pet|cat}}\n</gallery>\n<gallerybox>x</gallerybox>", g2)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Media) != 1 || len(collectLinks(a.MediaOptions[0].Caption)) != 1 {
+		t.Errorf("Error: template in gallery caption not expanded %v", a.MediaOptions)
+	}
+	if text := a.GetText(); !strings.Contains(text, "A cat") || !strings.Contains(text, "x") {
+		t.Errorf("Error: wrong text %q", text)
+	}
+
+	a, err = ParseArticle("Test", "A <gallery /> [[File:B.jpg]] C", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Media) != 1 || a.Media[0].PageName != "B.jpg" || strings.Contains(a.GetText(), "[[") {
+		t.Errorf("Error: self-closing gallery swallowed the text %v %q", a.Media, a.GetText())
+	}
+}
+
+func TestUploadURL(t *testing.T) {
+	wl := WikiCanonicalForm("File:example.jpg")
+	if u := wl.UploadURL(""); u != "//upload.wikimedia.org/wikipedia/commons/a/a9/Example.jpg" {
+		t.Errorf("Error: wrong upload url %q", u)
+	}
+	if u := wl.ThumbURL("https://upload.wikimedia.org/wikipedia/en/", 220); u != "https://upload.wikimedia.org/wikipedia/en/thumb/a/a9/Example.jpg/220px-Example.jpg" {
+		t.Errorf("Error: wrong thumb url %q", u)
+	}
+	wl = WikiCanonicalForm("File:Crystal Clear app kedit.svg")
+	if u := wl.ThumbURL("", 40); u != "//upload.wikimedia.org/wikipedia/commons/thumb/e/e8/Crystal_Clear_app_kedit.svg/40px-Crystal_Clear_app_kedit.svg.png" {
+		t.Errorf("Error: wrong svg thumb url %q", u)
+	}
+	wl = WikiCanonicalForm("File:Café (1).jpg")
+	if p := wl.UploadPath(); p != "/b/b4/Caf%C3%A9_(1).jpg" {
+		t.Errorf("Error: wrong upload path %q", p)
+	}
+	a, err := ParseArticleWithContext("Test", "[[File:Example.jpg]]", &DummyPageGetter{}, &PageContext{UploadPath: "/images"})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if u := a.FileURL(a.Media[0]); u != "/images/a/a9/Example.jpg" {
+		t.Errorf("Error: wrong file url %q", u)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	mw := "A<ref name=\"a\">First [[Foo]] {{cite web|url=http://x.org|title=X}}</ref> B<ref>Second [http://y.org y]</ref> " +
+		"C<ref name=a /> D<ref group=\"note\">Aside</ref> E<ref name=\"ld\"/>\n<references group=\"note\"/>\n== Notes ==\n" +
+		"<references>\n<ref name=\"ld\">Listed</ref>\n</references>"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	refs := a.GetReferences()
+	if len(refs) != 4 {
+		t.Fatalf("Error: wrong references %v", refs)
+	}
+	r := refs[0]
+	if r.Name != "a" || r.Number != 1 || len(r.Uses) != 2 || r.Text != "First Foo" || len(r.Links) != 1 ||
+		len(r.Templates) != 1 || r.Templates[0].Name != "cite web" {
+		t.Errorf("Error: wrong named reference %#v", r)
+	}
+	if r = refs[1]; r.Number != 2 || len(r.ExtLinks) != 1 || r.ExtLinks[0] != "http://y.org" {
+		t.Errorf("Error: wrong reference %#v", r)
+	}
+	if r = refs[2]; r.Group != "note" || r.Number != 1 || r.Label() != "note 1" || r.List == nil || r.List == refs[0].List {
+		t.Errorf("Error: wrong grouped reference %#v", r)
+	}
+	if r = refs[3]; r.Number != 3 || r.Text != "Listed" || r.List != refs[0].List || r.List == nil {
+		t.Errorf("Error: wrong list defined reference %#v", r)
+	}
+	var b bytes.Buffer
+	if err := a.RenderHTML(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	for _, s := range []string{
+		`C<sup id="cite_ref-a_1-1" class="reference"><a href="#cite_note-a-1">[1]</a></sup>`,
+		`<a href="#cite_note-3">[note 1]</a>`,
+		`<li id="cite_note-a-1">^ <a href="#cite_ref-a_1-0"><sup>a</sup></a> <a href="#cite_ref-a_1-1"><sup>b</sup></a> First`,
+		`<li id="cite_note-ld-4"><a href="#cite_ref-ld_4-0">^</a> Listed</li></ol>`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Error: %q not found in %q", s, b.String())
+		}
+	}
+
+	a, err = ParseArticle("Test", "x<ref>n</ref>\n{{Reflist}}\ny<ref>m</ref>", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	refs = a.GetReferences()
+	if len(refs) != 2 || refs[0].List == nil || refs[0].List.NSubType != "template" || refs[1].List != nil || refs[1].Number != 1 {
+		t.Fatalf("Error: wrong references with reflist %v", refs)
+	}
+	b.Reset()
+	if err := a.RenderMarkdown(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if s := b.String(); s != "x[^1]\n\n[^1]: n\n\ny[^2]\n\n[^2]: m\n" {
+		t.Errorf("Error: wrong markdown %q", s)
+	}
+
+	a, err = ParseArticle("Test", `x<ref name='x" onmouseover="alert(1)'>n</ref>`, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	b.Reset()
+	if err := a.RenderHTML(&b, nil); err != nil {
+		t.Fatal("Error:", err)
+	}
+	if s := b.String(); strings.Contains(s, `"_onmouseover`) || !strings.Contains(s, `id="cite_ref-x&#34;_onmouseover=&#34;alert(1)_1-0"`) {
+		t.Errorf("Error: reference name not escaped in %q", s)
+	}
+
+	a, err = ParseArticle("Test", "x<ref name=a>n</ref> y<ref name=a/> z<ref name=b/>\n<references>\n<ref name=b>m</ref>\n</references>", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	refs = a.GetReferences()
+	if len(refs) != 2 || refs[0].Name != "a" || len(refs[0].Uses) != 2 || refs[1].Name != "b" || refs[1].Number != 2 || refs[1].Text != "m" {
+		t.Errorf("Error: wrong references with self-closing tags %v", refs)
+	}
+}
+
+func TestCitations(t *testing.T) {
+	mw := "A<ref name=\"s\">{{cite journal |last1=Smith |first1=John |last2=Doe |first2=Jane |title=On ''Go'' & parsing " +
+		"|journal=[[Journal of Code]] |date=2 March 2020 |volume=3 |pages=1-10 |doi=10.1000/xyz |pmid=123}}</ref> " +
+		"B<ref>{{Cite web|author=Ann Lee|title=Home|website=Example|url=http://example.org/a_b?q={x}|access-date=2021-05-04|archive-url=http://archive.org/x}}</ref> " +
+		"{{cite book|last=Smith|first=J.|title=Book|year=2020|isbn=978-0-13-110362-7}}\n<references/>"
+	a, err := ParseArticle("Test", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	cs := a.Citations()
+	if len(cs) != 3 {
+		t.Fatalf("Error: wrong citations %v", cs)
+	}
+	c := cs[0]
+	if c.Type != "journal" || c.Key != "smith2020" || len(c.Authors) != 2 || c.Authors[1] != (CitationName{Family: "Doe", Given: "Jane"}) ||
+		c.Title != "On Go & parsing" || c.Container != "Journal of Code" || c.Date != (CitationDate{Raw: "2 March 2020", Year: 2020, Month: 3, Day: 2}) ||
+		c.DOI != "10.1000/xyz" || c.PMID != "123" || c.Reference != a.References[0] {
+		t.Errorf("Error: wrong journal citation %#v", c)
+	}
+	c = cs[1]
+	if c.Type != "web" || c.Key != "lee" || c.Authors[0].Literal != "Ann Lee" || c.Container != "Example" ||
+		c.AccessDate.Day != 4 || c.ArchiveURL != "http://archive.org/x" || c.Reference != a.References[1] {
+		t.Errorf("Error: wrong web citation %#v", c)
+	}
+	if c = cs[2]; c.Type != "book" || c.Key != "smith2020a" || c.ISBN != "978-0-13-110362-7" || c.Reference != nil {
+		t.Errorf("Error: wrong book citation %#v", c)
+	}
+	js, err := CSLJSON(cs[:2])
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	var items []map[string]interface{}
+	if err := json.Unmarshal(js, &items); err != nil || len(items) != 2 || items[0]["type"] != "article-journal" ||
+		items[0]["container-title"] != "Journal of Code" || !strings.Contains(string(js), `"date-parts": [`) ||
+		items[1]["archive_location"] != "http://archive.org/x" {
+		t.Errorf("Error: wrong CSL-JSON %s", js)
+	}
+	bib := BibTeX(cs[:2])
+	for _, s := range []string{"@article{smith2020,\n  author = {Smith, John and Doe, Jane},", "title = {On Go \\& parsing}",
+		"eprinttype = {pubmed}", "@misc{lee,\n  author = {{Ann Lee}},", "url = {http://example.org/a_b?q=%7Bx%7D},\n  urldate = {2021-05-04}",
+		"doi = {10.1000/xyz}", "note = {Archived at \\url{http://archive.org/x}}"} {
+		if !strings.Contains(bib, s) {
+			t.Errorf("Error: %q not found in BibTeX %q", s, bib)
+		}
+	}
+
+	a, err = ParseArticle("Test", strings.Repeat("{{cite book|last=Smith|year=2020}}", 28)+"{{cite book|last=Smith|title=2020a}}", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	cs = a.Citations()
+	if len(cs) != 29 || cs[1].Key != "smith2020a" || cs[26].Key != "smith2020z" || cs[27].Key != "smith2020aa" || cs[28].Key != "smith" {
+		t.Errorf("Error: wrong keys %q %q %q", cs[1].Key, cs[26].Key, cs[27].Key)
+	}
+
+	a, err = ParseArticle("Test", "{{cite web|last=Lee|title=A|date=March 2020|url=http://example.org|access-date=2020-05}}", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	cs = a.Citations()
+	if len(cs) != 1 || cs[0].Date != (CitationDate{Raw: "March 2020", Year: 2020, Month: 3}) || cs[0].AccessDate.Day != 0 {
+		t.Fatalf("Error: wrong month dates %v", cs)
+	}
+	if js, err = CSLJSON(cs); err != nil || !strings.Contains(strings.Join(strings.Fields(string(js)), ""), `"issued":{"date-parts":[[2020,3]]}`) {
+		t.Errorf("Error: wrong CSL-JSON %s", js)
+	}
+	if bib = BibTeX(cs); !strings.Contains(bib, "urldate = {2020-05}") || !strings.Contains(bib, "month = {3}") {
+		t.Errorf("Error: wrong BibTeX %q", bib)
+	}
+}
+
+func TestInfoboxes(t *testing.T) {
+	g := &mapPageGetter{pages: map[string]string{"Template:Convert": "{{{1}}} km"}}
+	mw := "{{Infobox settlement\n| name = [[Paris]]\n| area = {{convert|105|km2}}\n| website = [http://paris.fr paris.fr]\n" +
+		"| motto = <nowiki>[[x]]</nowiki>\n}}\n{{infobox_person|name=A}}\n{{Other|name=B}}"
+	a, err := ParseArticle("Test", mw, g)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	ibs := a.Infoboxes()
+	if len(ibs) != 2 || ibs[0].Name != "Infobox settlement" || ibs[1].Name != "Infobox person" || len(ibs[0].Params) != 4 {
+		t.Fatalf("Error: wrong infoboxes %v", ibs)
+	}
+	p := ibs[0].Param("name")
+	if p.Text != "Paris" || len(p.Links) != 1 || p.Links[0].PageName != "Paris" || p.Raw != "[[Paris]]" {
+		t.Errorf("Error: wrong parameter %#v", p)
+	}
+	p = ibs[0].Param("area")
+	if p.Raw != "{{convert|105|km2}}" || p.Text != "105 km" || len(p.Templates) != 1 || p.Templates[0].Name != "convert" ||
+		p.Templates[0].Parameters["2"] != "km2" {
+		t.Errorf("Error: wrong parameter %#v", p)
+	}
+	if p = ibs[0].Param("website"); len(p.ExtLinks) != 1 || p.Text != "paris.fr" {
+		t.Errorf("Error: wrong parameter %#v", p)
+	}
+	if p = ibs[0].Param("motto"); p.Raw != "<nowiki>[[x]]</nowiki>" || p.Text != "[[x]]" || len(p.Links) != 0 {
+		t.Errorf("Error: wrong parameter %#v", p)
+	}
+	a, err = ParseArticleWithContext("Test", mw, g, &PageContext{InfoboxPatterns: []string{"Other"}})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if ibs = a.Infoboxes(); len(ibs) != 1 || ibs[0].Param("name").Text != "B" {
+		t.Errorf("Error: wrong infoboxes with custom patterns %v", ibs)
+	}
+}
+
+const testMappingsYAML = `# settlement mappings
+mappings:
+- template: Infobox settlement
+  class: City
+  properties:
+    - parameter: country
+      property: country
+      type: link
+    - {parameter: x}
+`
+
+func TestMappings(t *testing.T) {
+	if _, err := LoadMappings(strings.NewReader(testMappingsYAML)); err == nil {
+		t.Error("Error: flow collections should not be accepted")
+	}
+	yml := strings.Replace(testMappingsYAML, "    - {parameter: x}\n", `    - parameter: founded  # the date
+      property: foundingDate
+      type: date
+    - parameter: area
+      property: "area total"
+      type: unit
+      unit: km2
+    - parameter: population
+      property: populationTotal
+      type: number
+`, 1)
+	js := `{"mappings": [{"template": "Infobox settlement", "class": "City", "properties": [
+		{"parameter": "country", "property": "country", "type": "link"},
+		{"parameter": "founded", "property": "foundingDate", "type": "date"},
+		{"parameter": "area", "property": "area total", "type": "unit", "unit": "km2"},
+		{"parameter": "population", "property": "populationTotal", "type": "number"}]}]}`
+	ym, err := LoadMappings(strings.NewReader(yml))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	jm, err := LoadMappings(strings.NewReader(js))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if fmt.Sprint(ym) != fmt.Sprint(jm) {
+		t.Fatalf("Error: YAML mappings %v differ from JSON %v", ym, jm)
+	}
+	mw := "{{infobox settlement\n| country = [[France]]\n| founded = 3rd century BC\n| area = 105.4\n" +
+		"| population = 2,165,423 (2019)\n| mayor = [[Anne Hidalgo]]\n| empty =\n}}"
+	a, err := ParseArticle("paris", mw, &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	r := ym.Apply(a)
+	expected := []Triple{
+		{Subject: "Paris", Property: "rdf:type", Type: "class", Value: "City"},
+		{Subject: "Paris", Property: "country", Type: "link", Value: "France"},
+		{Subject: "Paris", Property: "area total", Type: "unit", Value: "105.4", Number: 105.4, Unit: "km2"},
+		{Subject: "Paris", Property: "populationTotal", Type: "number", Value: "2165423", Number: 2165423},
+	}
+	if len(r.Triples) != len(expected) {
+		t.Fatalf("Error: wrong triples %v", r.Triples)
+	}
+	for i, tr := range r.Triples {
+		tr.Link = nil
+		if tr != expected[i] {
+			t.Errorf("Error: triple %v, expected %v", tr, expected[i])
+		}
+	}
+	if len(r.Unmapped) != 1 || r.Unmapped[0].Parameter != "mayor" || len(r.Invalid) != 1 || r.Invalid[0].Parameter != "founded" {
+		t.Errorf("Error: wrong report %v %v", r.Unmapped, r.Invalid)
+	}
+
+	pm, err := LoadMappings(strings.NewReader(`{"mappings": [{"template": "Infobox person", "properties": [
+		{"parameter": "birth_date", "property": "birthDate", "type": "date"},
+		{"parameter": "start", "property": "activeYearsStartYear", "type": "date"},
+		{"parameter": "mass", "property": "mass", "type": "unit"}]}]}`))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	mw = "{{Infobox person\n| birth_date = {{birth date|df=y|1950|1|2}}\n| start = {{Start date|1970}}\n| mass = 1.5e3 kg\n}}"
+	if a, err = ParseArticle("Test", mw, &DummyPageGetter{}); err != nil {
+		t.Fatal("Error:", err)
+	}
+	r = pm.Apply(a)
+	expected = []Triple{
+		{Subject: "Test", Property: "birthDate", Type: "date", Value: "1950-01-02"},
+		{Subject: "Test", Property: "activeYearsStartYear", Type: "date", Value: "1970"},
+		{Subject: "Test", Property: "mass", Type: "unit", Value: "1500", Number: 1500, Unit: "kg"},
+	}
+	if len(r.Triples) != len(expected) || len(r.Invalid) != 0 {
+		t.Fatalf("Error: wrong triples %v, invalid %v", r.Triples, r.Invalid)
+	}
+	for i, tr := range r.Triples {
+		if tr != expected[i] {
+			t.Errorf("Error: triple %v, expected %v", tr, expected[i])
+		}
+	}
+}
+
+func TestTemplateParams(t *testing.T) {
+	mw := "<nowiki>{{x}}</nowiki> x <!-- {{y}} -->{{Foo|pos\n| b = 1 <!-- c -->\n| a = {{bar}}\n| b = <nowiki>|</nowiki>2\n}}"
+	g := &mapPageGetter{pages: map[string]string{"Template:Bar": "BAR"}}
+	a, err := ParseArticle("Test", mw, g)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(a.Templates) != 1 {
+		t.Fatalf("Error: wrong templates %v", a.Templates)
+	}
+	ps := a.Templates[0].Params
+	if len(ps) != 4 {
+		t.Fatalf("Error: wrong parameters %v", ps)
+	}
+	expected := []TemplateParam{
+		{Name: "1", Positional: true, Raw: "pos\n", Value: "pos"},
+		{Name: "b", Raw: " b = 1 <!-- c -->\n", Value: "1", Duplicate: true},
+		{Name: "a", Raw: " a = {{bar}}\n", Value: "BAR"},
+		{Name: "b", Raw: " b = <nowiki>|</nowiki>2\n", Value: "<nowiki>|</nowiki>2"},
+	}
+	for i, p := range ps {
+		if mw[p.Start:p.End] != p.Raw {
+			t.Errorf("Error: wrong span of %q: %q", p.Raw, mw[p.Start:p.End])
+		}
+		p.Start, p.End, p.source = 0, 0, ""
+		if p != expected[i] {
+			t.Errorf("Error: parameter %#v, expected %#v", p, expected[i])
+		}
+	}
+	if a.Templates[0].Parameters["b"] == "1" {
+		t.Error("Error: the last duplicate parameter should win")
+	}
+
+	a, err = ParseArticle("Test", "{{T|a=1|b|c}}{{T|1=a|b}}", &DummyPageGetter{})
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	ps = a.Templates[0].Params
+	if len(ps) != 3 || ps[1].Name != "1" || ps[2].Name != "2" || a.Templates[0].Parameters["1"] != "b" {
+		t.Errorf("Error: wrong positional parameters %v", ps)
+	}
+	ps = a.Templates[1].Params
+	if len(ps) != 2 || !ps[0].Duplicate || ps[1].Duplicate || ps[1].Name != "1" || a.Templates[1].Parameters["1"] != "b" {
+		t.Errorf("Error: wrong duplicate parameters %v", ps)
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HTMLOptions configures RenderHTML. Nil functions get default
+// implementations.
+type HTMLOptions struct {
+	// LinkURL returns the url of an internal link. By default it is built
+	// from the article path of the page context.
+	LinkURL func(wl WikiLink) string
+	// ImageURL returns the url of the image of a file link. By default
+	// images are rendered as links to their file page.
+	ImageURL func(wl WikiLink) string
+}
+
+// tags and attributes allowed in the html output, as in MediaWiki's
+// Sanitizer
+var htmlAllowedTags = map[string]bool{
+	"b": true, "i": true, "u": true, "s": true, "del": true, "ins": true, "big": true, "small": true,
+	"sub": true, "sup": true, "span": true, "div": true, "p": true, "br": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "tr": true, "td": true, "th": true, "caption": true, "tbody": true, "thead": true, "tfoot": true,
+	"blockquote": true, "center": true, "code": true, "tt": true, "kbd": true, "var": true, "samp": true,
+	"cite": true, "q": true, "strike": true, "font": true, "abbr": true, "dfn": true, "em": true, "strong": true,
+	"ruby": true, "rb": true, "rt": true, "rp": true, "rtc": true, "bdi": true, "bdo": true, "mark": true,
+	"wbr": true, "data": true, "time": true, "pre": true,
+}
+
+var htmlVoidTags = map[string]bool{"br": true, "hr": true, "wbr": true}
+
+var htmlBlockTags = map[string]bool{
+	"div": true, "p": true, "hr": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "dl": true, "table": true, "blockquote": true, "center": true, "pre": true,
+	"references": true,
+}
+
+var htmlAllowedAttrs = map[string]bool{
+	"class": true, "id": true, "style": true, "title": true, "lang": true, "dir": true,
+	"colspan": true, "rowspan": true, "align": true, "valign": true, "width": true, "height": true,
+	"bgcolor": true, "border": true, "cellpadding": true, "cellspacing": true, "scope": true,
+	"abbr": true, "headers": true, "cite": true, "datetime": true, "start": true, "type": true,
+	"value": true, "reversed": true, "color": true, "size": true, "face": true,
+}
+
+var htmlUnsafeStyle = []string{"expression", "url(", "javascript", "behavior", "-moz-binding", "\\"}
+
+type htmlRenderer struct {
+	a      *Article
+	opts   HTMLOptions
+	w      io.Writer
+	err    error
+	ids    map[string]int
+	extNum int
+}
+
+// RenderHTML writes the html rendering of the parse tree of the article
+// to w. Only the tags and attributes allowed by MediaWiki are output, and
+// all the text is escaped.
+func (a *Article) RenderHTML(w io.Writer, opts *HTMLOptions) error {
+	r := &htmlRenderer{a: a, w: w, ids: make(map[string]int)}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.LinkURL == nil {
+		r.opts.LinkURL = a.defaultLinkURL
+	}
+	if a.Root != nil {
+		r.renderBlocks(a.Root.Nodes)
+	}
+	r.renderReferences(nil)
+	return r.err
+}
+
+func (a *Article) defaultLinkURL(wl WikiLink) string {
+	if iw, ok := a.interwikis()[wl.Interwiki]; ok && wl.IsInterwiki() {
+		return iw.PageURL(wl)
+	}
+	anchor := ""
+	if wl.HasAnchor() {
+		anchor = "#" + anchorEncode(wl.Anchor)
+	}
+	if wl.IsImplicitSelfLink() {
+		return anchor
+	}
+	return strings.Replace(a.context().ArticlePath, "$1", wikiURLEncode(wl.FullPagename()), 1) + anchor
+}
+
+func (r *htmlRenderer) write(s string) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = io.WriteString(r.w, s)
+}
+
+func (r *htmlRenderer) text(s string) {
+	r.write(html.EscapeString(s))
+}
+
+func isBlockNode(n *ParseNode) bool {
+	switch n.NType {
+	case "break", "redirect", "gallery", "references":
+		return true
+	case "html":
+		return htmlBlockTags[n.NSubType]
+	}
+	return false
+}
+
+// renderBlocks renders top level nodes, wrapping runs of inline nodes in
+// paragraphs.
+func (r *htmlRenderer) renderBlocks(nodes []*ParseNode) {
+	b := 0
+	flush := func(e int) {
+		inline := nodes[b:e]
+		empty := true
+		for _, n := range inline {
+			if !(n.NType == "space" || n.NType == "tb" || n.NType == "te" || n.NType == "magic" ||
+				n.NType == "text" && len(strings.TrimSpace(n.Contents)) == 0) {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			r.write("<p>")
+			r.renderNodes(inline)
+			r.write("</p>\n")
+		}
+	}
+	for i, n := range nodes {
+		if !isBlockNode(n) {
+			continue
+		}
+		flush(i)
+		if n.NType != "break" {
+			r.renderNode(n)
+			r.write("\n")
+		}
+		b = i + 1
+	}
+	flush(len(nodes))
+}
+
+func (r *htmlRenderer) renderNodes(nodes []*ParseNode) {
+	for _, n := range nodes {
+		r.renderNode(n)
+	}
+}
+
+func (r *htmlRenderer) renderNode(n *ParseNode) {
+	switch n.NType {
+	case "text":
+		r.text(n.Contents)
+	case "space":
+		r.write(" ")
+	case "break":
+		r.write("<br>")
+	case "math":
+		r.write(`<span class="texhtml">`)
+		r.text(n.Contents)
+		r.write("</span>")
+	case "link":
+		r.write(`<a href="`)
+		r.text(r.opts.LinkURL(n.Link))
+		r.write(`" title="`)
+		r.text(n.Link.FullPagename())
+		r.write(`">`)
+		if len(n.Nodes) > 0 {
+			r.renderNodes(n.Nodes)
+		} else {
+			r.text(n.Link.FullPagenameAnchor())
+		}
+		r.write("</a>")
+	case "extlink":
+		r.renderExtLink(n)
+	case "magiclink":
+		u, ok := r.a.magicLinkURL(n.NSubType, n.Contents)
+		if !ok {
+			u = r.opts.LinkURL(r.a.isbnLink(n.Contents))
+		}
+		r.write(`<a class="mw-magiclink-` + strings.ToLower(n.NSubType) + `" href="`)
+		r.text(u)
+		r.write(`">`)
+		r.renderNodes(n.Nodes)
+		r.write("</a>")
+	case "image":
+		r.renderImage(n)
+	case "gallery":
+		r.renderGallery(n)
+	case "ref":
+		r.renderRef(n)
+	case "references":
+		r.renderReferences(n)
+	case "redirect":
+		r.write(`<div class="redirectMsg">Redirect to: <a href="`)
+		r.text(r.opts.LinkURL(n.Link))
+		r.write(`">`)
+		r.text(n.Link.FullPagenameAnchor())
+		r.write("</a></div>")
+	case "html":
+		r.renderHTMLNode(n)
+	default:
+		// templates markers and behavior switches produce no output
+		r.renderNodes(n.Nodes)
+	}
+}
+
+func (r *htmlRenderer) renderExtLink(n *ParseNode) {
+	if !r.a.isExtLink(n.Contents) {
+		r.text("[" + n.Contents)
+		if len(n.Nodes) > 0 {
+			r.write(" ")
+			r.renderNodes(n.Nodes)
+		}
+		r.write("]")
+		return
+	}
+	r.write(`<a rel="nofollow" class="external" href="`)
+	r.text(n.Contents)
+	r.write(`">`)
+	if len(n.Nodes) > 0 {
+		r.renderNodes(n.Nodes)
+	} else {
+		r.extNum++
+		r.write("[" + strconv.Itoa(r.extNum) + "]")
+	}
+	r.write("</a>")
+}
+
+// renderImage renders a file link. The caption is output as plain text, as
+// it can contain links that cannot be nested in the one to the file.
+func (r *htmlRenderer) renderImage(n *ParseNode) {
+	caption, _ := r.a.genNodesText(n.Nodes)
+	caption = strings.TrimSpace(caption)
+	r.write(`<a href="`)
+	r.text(r.opts.LinkURL(n.Link))
+	r.write(`" class="image">`)
+	if r.opts.ImageURL != nil {
+		alt := caption
+		if opts, ok := r.a.nodeMedia[n]; ok && len(opts.Alt) > 0 {
+			alt = opts.Alt
+		}
+		r.write(`<img src="`)
+		r.text(r.opts.ImageURL(n.Link))
+		r.write(`" alt="`)
+		r.text(alt)
+		r.write(`">`)
+	} else if len(caption) > 0 {
+		r.text(caption)
+	} else {
+		r.text(n.Link.FullPagename())
+	}
+	r.write("</a>")
+}
+
+// renderGallery renders a gallery as a list of images, each followed by its
+// caption when the images are shown.
+func (r *htmlRenderer) renderGallery(n *ParseNode) {
+	r.write(`<ul class="gallery">`)
+	if caption := parseAttributes(n.Contents)["caption"]; len(caption) > 0 {
+		r.write(`<li class="gallerycaption">`)
+		r.text(caption)
+		r.write("</li>")
+	}
+	for _, c := range n.Nodes {
+		if c.NType != "image" {
+			continue
+		}
+		r.write(`<li class="gallerybox">`)
+		r.renderImage(c)
+		if r.opts.ImageURL != nil && len(c.Nodes) > 0 {
+			r.write(`<div class="gallerytext">`)
+			r.renderNodes(c.Nodes)
+			r.write("</div>")
+		}
+		r.write("</li>")
+	}
+	r.write("</ul>")
+}
+
+func (r *htmlRenderer) attributes(attr string) string {
+	out := ""
+	for _, p := range parseAttributeList(attr) {
+		if !htmlAllowedAttrs[p[0]] {
+			continue
+		}
+		if p[0] == "style" {
+			ls := strings.ToLower(p[1])
+			unsafe := false
+			for _, u := range htmlUnsafeStyle {
+				if strings.Contains(ls, u) {
+					unsafe = true
+				}
+			}
+			if unsafe {
+				continue
+			}
+		}
+		out += " " + p[0] + `="` + html.EscapeString(p[1]) + `"`
+	}
+	return out
+}
+
+func (r *htmlRenderer) headingId(n *ParseNode) string {
+	text, _ := r.a.genNodesText(n.Nodes)
+	id := anchorEncode(text)
+	r.ids[id]++
+	if c := r.ids[id]; c > 1 {
+		id += "_" + strconv.Itoa(c)
+	}
+	return id
+}
+
+func (r *htmlRenderer) renderHTMLNode(n *ParseNode) {
+	tag := n.NSubType
+	if !htmlAllowedTags[tag] {
+		r.renderNodes(n.Nodes)
+		return
+	}
+	attrs := r.attributes(n.Contents)
+	switch tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if !strings.Contains(attrs, ` id="`) {
+			attrs += ` id="` + html.EscapeString(r.headingId(n)) + `"`
+		}
+	}
+	r.write("<" + tag + attrs + ">")
+	if htmlVoidTags[tag] {
+		return
+	}
+	r.renderNodes(n.Nodes)
+	r.write("</" + tag + ">")
+}
+
+func (r *htmlRenderer) renderRef(n *ParseNode) {
+	u, ok := r.a.refUses[n]
+	if !ok {
+		return
+	}
+	r.write(`<sup id="` + html.EscapeString(u.ref.useId(u.use)) + `" class="reference"><a href="#` + html.EscapeString(u.ref.noteId()) + `">[`)
+	r.text(u.ref.Label())
+	r.write(`]</a></sup>`)
+}
+
+// renderReferences writes the footnotes listed by the references node n, or
+// those left for the end of the page if n is nil.
+func (r *htmlRenderer) renderReferences(n *ParseNode) {
+	refs := r.a.listedReferences(n)
+	if len(refs) == 0 {
+		return
+	}
+	r.write(`<ol class="references">`)
+	for _, ref := range refs {
+		r.write(`<li id="` + html.EscapeString(ref.noteId()) + `">`)
+		if len(ref.Uses) == 1 {
+			r.write(`<a href="#` + html.EscapeString(ref.useId(0)) + `">^</a>`)
+		} else {
+			r.write("^")
+			for i := range ref.Uses {
+				r.write(` <a href="#` + html.EscapeString(ref.useId(i)) + `"><sup>` + backrefLabel(i) + `</sup></a>`)
+			}
+		}
+		if ref.Node != nil {
+			r.write(" ")
+			r.renderNodes(ref.Node.Nodes)
+		}
+		r.write("</li>")
+	}
+	r.write("</ol>")
+}
+
+// backrefLabel returns the label of the i-th back reference of a footnote
+// cited more than once: a, b, ..., z, aa, ab, ...
+func backrefLabel(i int) string {
+	if i < 26 {
+		return string(rune('a' + i))
+	}
+	return backrefLabel(i/26-1) + string(rune('a'+i%26))
+}
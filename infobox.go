@@ -0,0 +1,100 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultInfoboxPatterns are the names of the infobox templates, as
+// patterns of path.Match.
+var DefaultInfoboxPatterns = []string{"Infobox", "Infobox *"}
+
+// Infobox is a template call matching the infobox patterns of the wiki.
+type Infobox struct {
+	Name     string // name of the template, e.g. "Infobox person"
+	Template *Template
+	Params   []*InfoboxParam // in order of appearance
+}
+
+// InfoboxParam is a parameter of an infobox, with its value parsed.
+type InfoboxParam struct {
+	Name      string
+	Raw       string       // source of the value
+	Value     string       // value with the templates expanded
+	Nodes     []*ParseNode // parse tree of Value
+	Text      string       // plain text of Value
+	Links     []WikiLink   // internal links of Value
+	ExtLinks  []string     // external links of Value
+	Templates []*Template  // templates called in Raw
+}
+
+// Param returns the last parameter named name, or nil if there is none.
+func (ib *Infobox) Param(name string) *InfoboxParam {
+	for i := len(ib.Params) - 1; i >= 0; i-- {
+		if ib.Params[i].Name == name {
+			return ib.Params[i]
+		}
+	}
+	return nil
+}
+
+// isInfobox tells if the template named name matches the infobox patterns.
+func (a *Article) isInfobox(name string) bool {
+	for _, p := range a.context().InfoboxPatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Infoboxes returns the infoboxes of the article, in order of appearance,
+// parsing the values of their parameters. The templates in the values are
+// those expanded while parsing the article, the other ones are not expanded.
+func (a *Article) Infoboxes() []*Infobox {
+	out := make([]*Infobox, 0, 1)
+	for _, t := range a.Templates {
+		if t.Typ != "normal" {
+			continue
+		}
+		wl := a.namespaces().WikiCanonicalFormNamespaceEsc(t.Name, "Template", true)
+		if wl.NamespaceId != 10 || !a.isInfobox(wl.PageName) {
+			continue
+		}
+		ib := &Infobox{Name: wl.PageName, Template: t, Params: make([]*InfoboxParam, 0, len(t.Params))}
+		for i, p := range t.Params {
+			ib.Params = append(ib.Params, a.parseInfoboxParam(p, t.inner[i]))
+		}
+		out = append(out, ib)
+	}
+	return out
+}
+
+// parseInfoboxParam parses the value of p, templates being those it calls.
+func (a *Article) parseInfoboxParam(p TemplateParam, templates []*Template) *InfoboxParam {
+	ip := &InfoboxParam{Name: p.Name, Raw: p.source, Value: p.Value, Templates: templates}
+	if v, err := ParseArticleWithContext(a.Title, p.Value, &DummyPageGetter{}, a.Context); err == nil {
+		ip.Nodes = v.Root.Nodes
+		text, _ := v.genNodesText(ip.Nodes)
+		ip.Text = strings.TrimSpace(text)
+		ip.Links = collectLinks(ip.Nodes)
+		ip.ExtLinks = collectExtLinks(ip.Nodes)
+	}
+	return ip
+}
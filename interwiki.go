@@ -0,0 +1,137 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"html"
+	"strings"
+)
+
+// Interwiki is an entry of the interwiki table, mapping a link prefix to
+// another wiki.
+type Interwiki struct {
+	Prefix   string
+	URL      string // url of the pages of the wiki, $1 standing for the title
+	Language bool   // true for the prefixes of interlanguage links
+}
+
+// Interwikis maps the lowercase interwiki prefixes to their description.
+type Interwikis map[string]*Interwiki
+
+// NewInterwikis builds an interwiki table.
+func NewInterwikis(list []Interwiki) Interwikis {
+	out := make(Interwikis)
+	for i := range list {
+		iw := list[i]
+		iw.Prefix = strings.ToLower(iw.Prefix)
+		out[iw.Prefix] = &iw
+	}
+	return out
+}
+
+// language editions of Wikipedia
+var wikipediaLanguages = strings.Fields(`
+aa ab ace ady af ak als alt am ami an ang anp ar arc ary arz as ast atj av avk awa ay az azb
+ba ban bar bat-smg bcl be be-x-old bg bh bi bjn blk bm bn bo bpy br bs bug bxr
+ca cbk-zam cdo ce ceb ch cho chr chy ckb co cr crh cs csb cu cv cy
+da dag de din diq dsb dty dv dz ee el eml en eo es et eu ext
+fa fat ff fi fiu-vro fj fo fon fr frp frr fur fy ga gag gan gcr gd gl glk gn gom gor got gpe gu guc gur guw gv
+ha hak haw he hi hif ho hr hsb ht hu hy hyw hz ia id ie ig ii ik ilo inh io is it iu
+ja jam jbo jv ka kaa kab kbd kbp kcg kg ki kj kk kl km kn ko koi kr krc ks ksh ku kv kw ky
+la lad lb lbe lez lfn lg li lij lld lmo ln lo lrc lt ltg lv
+mad mai map-bms mdf mg mh mhr mi min mk ml mn mni mnw mo mr mrj ms mt mus mwl my myv mzn
+na nah nap nds nds-nl ne new ng nia nl nn no nov nqo nrm nso nv ny oc olo om or os
+pa pag pam pap pcd pcm pdc pfl pi pih pl pms pnb pnt ps pt pwn qu
+rm rmy rn ro roa-rup roa-tara ru rue rw sa sah sat sc scn sco sd se sg sh shi shn si simple sk skr sl sm smn sn so sq sr srn ss st stq su sv sw szl szy
+ta tay tcy te tet tg th ti tk tl tly tn to tpi tr trv ts tt tum tw ty tyv udm ug uk ur uz
+ve vec vep vi vls vo wa war wo wuu xal xh xmf yi yo za zea zh zh-classical zh-min-nan zh-yue zu`)
+
+// prefixes of the Wikimedia projects
+var wikimediaPrefixes = [][3]string{
+	{"wikipedia", "w", "https://en.wikipedia.org/wiki/$1"},
+	{"wiktionary", "wikt", "https://en.wiktionary.org/wiki/$1"},
+	{"wikibooks", "b", "https://en.wikibooks.org/wiki/$1"},
+	{"wikiquote", "q", "https://en.wikiquote.org/wiki/$1"},
+	{"wikisource", "s", "https://en.wikisource.org/wiki/$1"},
+	{"wikinews", "n", "https://en.wikinews.org/wiki/$1"},
+	{"wikiversity", "v", "https://en.wikiversity.org/wiki/$1"},
+	{"wikivoyage", "voy", "https://en.wikivoyage.org/wiki/$1"},
+	{"commons", "c", "https://commons.wikimedia.org/wiki/$1"},
+	{"meta", "m", "https://meta.wikimedia.org/wiki/$1"},
+	{"wikispecies", "species", "https://species.wikimedia.org/wiki/$1"},
+	{"wikidata", "d", "https://www.wikidata.org/wiki/$1"},
+	{"mediawikiwiki", "mw", "https://www.mediawiki.org/wiki/$1"},
+	{"foundation", "wmf", "https://foundation.wikimedia.org/wiki/$1"},
+	{"phabricator", "phab", "https://phabricator.wikimedia.org/$1"},
+}
+
+// StandardInterwikis is the interwiki table of the English Wikipedia,
+// restricted to the language editions of Wikipedia and the Wikimedia
+// projects.
+var StandardInterwikis Interwikis = standardInterwikis()
+
+func standardInterwikis() Interwikis {
+	list := make([]Interwiki, 0, len(wikipediaLanguages)+2*len(wikimediaPrefixes))
+	for _, l := range wikipediaLanguages {
+		list = append(list, Interwiki{Prefix: l, URL: "https://" + l + ".wikipedia.org/wiki/$1", Language: true})
+	}
+	for _, p := range wikimediaPrefixes {
+		list = append(list, Interwiki{Prefix: p[0], URL: p[2]}, Interwiki{Prefix: p[1], URL: p[2]})
+	}
+	return NewInterwikis(list)
+}
+
+// interwikis returns the interwiki table used to interpret links.
+func (a *Article) interwikis() Interwikis {
+	return a.context().Interwikis
+}
+
+// interwikiLink returns the link to another wiki the link target l points
+// to, if it starts with a prefix of the interwiki table that is not a
+// namespace.
+func (a *Article) interwikiLink(l string) (WikiLink, *Interwiki, bool) {
+	l = strings.TrimPrefix(strings.TrimSpace(l), ":")
+	i := strings.Index(l, ":")
+	if i <= 0 {
+		return WikiLink{}, nil, false
+	}
+	prefix := strings.ToLower(strings.TrimSpace(canoReSpaces.ReplaceAllString(html.UnescapeString(l[:i]), " ")))
+	if _, ok := a.namespaces().ByName(prefix); ok {
+		return WikiLink{}, nil, false
+	}
+	iw, ok := a.interwikis()[prefix]
+	if !ok {
+		return WikiLink{}, nil, false
+	}
+	page := l[i+1:]
+	anchor := ""
+	if hpos := strings.IndexRune(page, '#'); hpos >= 0 {
+		anchor = html.UnescapeString(canoReSpaces.ReplaceAllString(page[hpos+1:], " "))
+		page = page[:hpos]
+	}
+	page = html.UnescapeString(strings.TrimSpace(canoReSpaces.ReplaceAllString(page, " ")))
+	return WikiLink{Interwiki: iw.Prefix, PageName: page, Anchor: anchor}, iw, true
+}
+
+// PageURL returns the url of the page wl on the other wiki.
+func (iw *Interwiki) PageURL(wl WikiLink) string {
+	u := strings.Replace(iw.URL, "$1", wikiURLEncode(wl.PageName), 1)
+	if wl.HasAnchor() {
+		u += "#" + anchorEncode(wl.Anchor)
+	}
+	return u
+}
@@ -0,0 +1,539 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var magicFunctions map[string]parserFunction
+
+func init() {
+	magicFunctions = map[string]parserFunction{
+		"lc":               mfLc,
+		"uc":               mfUc,
+		"lcfirst":          mfLcfirst,
+		"ucfirst":          mfUcfirst,
+		"padleft":          mfPadleft,
+		"padright":         mfPadright,
+		"urlencode":        mfUrlencode,
+		"anchorencode":     mfAnchorencode,
+		"formatnum":        mfFormatnum,
+		"plural":           mfPlural,
+		"gender":           mfGender,
+		"ns":               mfNs,
+		"nse":              mfNse,
+		"localurl":         mfLocalurl,
+		"localurle":        mfLocalurle,
+		"special":          mfSpecial,
+		"speciale":         mfSpeciale,
+		"pagename":         titleMagic(pageName, false),
+		"pagenamee":        titleMagic(pageName, true),
+		"fullpagename":     titleMagic(fullPageName, false),
+		"fullpagenamee":    titleMagic(fullPageName, true),
+		"namespace":        titleMagic(namespaceName, false),
+		"namespacee":       titleMagic(namespaceName, true),
+		"namespacenumber":  titleMagic(namespaceNumber, false),
+		"talkspace":        titleMagic(talkSpace, false),
+		"talkspacee":       titleMagic(talkSpace, true),
+		"subjectspace":     titleMagic(subjectSpace, false),
+		"subjectspacee":    titleMagic(subjectSpace, true),
+		"talkpagename":     titleMagic(talkPageName, false),
+		"talkpagenamee":    titleMagic(talkPageName, true),
+		"subjectpagename":  titleMagic(subjectPageName, false),
+		"subjectpagenamee": titleMagic(subjectPageName, true),
+		"basepagename":     titleMagic(basePageName, false),
+		"basepagenamee":    titleMagic(basePageName, true),
+		"rootpagename":     titleMagic(rootPageName, false),
+		"rootpagenamee":    titleMagic(rootPageName, true),
+		"subpagename":      titleMagic(subPageName, false),
+		"subpagenamee":     titleMagic(subPageName, true),
+		"fullurl":          mfFullurl,
+		"fullurle":         mfFullurle,
+		"canonicalurl":     mfCanonicalurl,
+		"canonicalurle":    mfCanonicalurle,
+		"pagesize":         mfPagesize,
+
+		"currentyear":         timeMagic(currentTime, "2006"),
+		"currentmonth":        timeMagic(currentTime, "01"),
+		"currentmonth1":       timeMagic(currentTime, "1"),
+		"currentmonthname":    timeMagic(currentTime, "January"),
+		"currentmonthnamegen": timeMagic(currentTime, "January"),
+		"currentmonthabbrev":  timeMagic(currentTime, "Jan"),
+		"currentday":          timeMagic(currentTime, "2"),
+		"currentday2":         timeMagic(currentTime, "02"),
+		"currentdayname":      timeMagic(currentTime, "Monday"),
+		"currentdow":          timeMagic(currentTime, "dow"),
+		"currenttime":         timeMagic(currentTime, "15:04"),
+		"currenthour":         timeMagic(currentTime, "15"),
+		"currentweek":         timeMagic(currentTime, "week"),
+		"currenttimestamp":    timeMagic(currentTime, "20060102150405"),
+		"localyear":           timeMagic(localTime, "2006"),
+		"localmonth":          timeMagic(localTime, "01"),
+		"localmonth1":         timeMagic(localTime, "1"),
+		"localmonthname":      timeMagic(localTime, "January"),
+		"localmonthnamegen":   timeMagic(localTime, "January"),
+		"localmonthabbrev":    timeMagic(localTime, "Jan"),
+		"localday":            timeMagic(localTime, "2"),
+		"localday2":           timeMagic(localTime, "02"),
+		"localdayname":        timeMagic(localTime, "Monday"),
+		"localdow":            timeMagic(localTime, "dow"),
+		"localtime":           timeMagic(localTime, "15:04"),
+		"localhour":           timeMagic(localTime, "15"),
+		"localweek":           timeMagic(localTime, "week"),
+		"localtimestamp":      timeMagic(localTime, "20060102150405"),
+		"revisionyear":        timeMagic(revisionTime, "2006"),
+		"revisionmonth":       timeMagic(revisionTime, "01"),
+		"revisionmonth1":      timeMagic(revisionTime, "1"),
+		"revisionday":         timeMagic(revisionTime, "2"),
+		"revisionday2":        timeMagic(revisionTime, "02"),
+		"revisiontimestamp":   timeMagic(revisionTime, "20060102150405"),
+
+		"revisionid":      contextMagic(func(pc *PageContext) string { return formatId(pc.RevisionId) }),
+		"revisionuser":    contextMagic(func(pc *PageContext) string { return pc.RevisionUser }),
+		"pageid":          contextMagic(func(pc *PageContext) string { return formatId(pc.PageId) }),
+		"sitename":        contextMagic(func(pc *PageContext) string { return pc.SiteName }),
+		"server":          contextMagic(func(pc *PageContext) string { return pc.Server }),
+		"servername":      contextMagic(func(pc *PageContext) string { return serverName(pc.Server) }),
+		"articlepath":     contextMagic(func(pc *PageContext) string { return pc.ArticlePath }),
+		"scriptpath":      contextMagic(func(pc *PageContext) string { return pc.ScriptPath }),
+		"stylepath":       contextMagic(func(pc *PageContext) string { return pc.ScriptPath + "/skins" }),
+		"contentlanguage": contextMagic(func(pc *PageContext) string { return pc.ContentLanguage }),
+		"directionmark":   contextMagic(func(pc *PageContext) string { return "\u200e" }),
+		"revisionsize":    mfPagesize,
+
+		"defaultsort":         mfDefaultsort,
+		"defaultsortkey":      mfDefaultsort,
+		"defaultcategorysort": mfDefaultsort,
+	}
+}
+
+func (a *Article) renderTemplateMagic(name string, params map[string]string, g PageGetter) string {
+	fn, arg0 := splitParserFunctionName(name)
+	f, ok := magicFunctions[fn]
+	if !ok {
+		return ""
+	}
+	return f(a, g, arg0, paramsToArgs(params))
+}
+
+func (a *Article) context() *PageContext {
+	if a.Context == nil {
+		a.Context = (*PageContext)(nil).withDefaults()
+	}
+	return a.Context
+}
+
+func contextMagic(f func(pc *PageContext) string) parserFunction {
+	return func(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+		return f(a.context())
+	}
+}
+
+func currentTime(pc *PageContext) time.Time {
+	return pc.Now.UTC()
+}
+
+func localTime(pc *PageContext) time.Time {
+	return pc.Now.In(pc.Location)
+}
+
+func revisionTime(pc *PageContext) time.Time {
+	return pc.RevisionTimestamp.UTC()
+}
+
+// timeMagic builds a time variable formatting the time chosen by f with the
+// given Go layout, or "dow" and "week" for the day of the week and the ISO
+// week number.
+func timeMagic(f func(pc *PageContext) time.Time, layout string) parserFunction {
+	return func(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+		t := f(a.context())
+		if t.IsZero() {
+			return ""
+		}
+		switch layout {
+		case "dow":
+			return strconv.Itoa(int(t.Weekday()))
+		case "week":
+			_, w := t.ISOWeek()
+			return strconv.Itoa(w)
+		}
+		return t.Format(layout)
+	}
+}
+
+func formatId(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+func serverName(server string) string {
+	if i := strings.Index(server, "//"); i >= 0 {
+		server = server[i+2:]
+	}
+	if i := strings.IndexAny(server, ":/"); i >= 0 {
+		server = server[:i]
+	}
+	return server
+}
+
+// namespaces returns the namespace table used to interpret titles.
+func (a *Article) namespaces() *NamespaceTable {
+	return a.context().Namespaces
+}
+
+// titleMagic builds the magic word returning f of the title given as
+// argument, or of the article title if none is given.
+func titleMagic(f func(nss *NamespaceTable, wl WikiLink) string, encode bool) parserFunction {
+	return func(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+		t := a.Title
+		if len(arg0) > 0 {
+			t = arg0
+		}
+		if len(strings.TrimSpace(t)) == 0 {
+			return ""
+		}
+		nss := a.namespaces()
+		s := f(nss, nss.WikiCanonicalFormNamespaceEsc(t, "", true))
+		if encode {
+			return wikiURLEncode(s)
+		}
+		return s
+	}
+}
+
+func pageName(nss *NamespaceTable, wl WikiLink) string {
+	return wl.PageName
+}
+
+func fullPageName(nss *NamespaceTable, wl WikiLink) string {
+	return wl.FullPagename()
+}
+
+func namespaceName(nss *NamespaceTable, wl WikiLink) string {
+	return wl.Namespace
+}
+
+func namespaceNumber(nss *NamespaceTable, wl WikiLink) string {
+	ns, ok := nss.ByName(wl.Namespace)
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(ns.Id)
+}
+
+func talkSpace(nss *NamespaceTable, wl WikiLink) string {
+	t, ok := nss.TalkPage(wl)
+	if !ok {
+		return ""
+	}
+	return t.Namespace
+}
+
+func subjectSpace(nss *NamespaceTable, wl WikiLink) string {
+	sp, ok := nss.SubjectPage(wl)
+	if !ok {
+		return wl.Namespace
+	}
+	return sp.Namespace
+}
+
+func talkPageName(nss *NamespaceTable, wl WikiLink) string {
+	t, ok := nss.TalkPage(wl)
+	if !ok {
+		return ""
+	}
+	return t.FullPagename()
+}
+
+func subjectPageName(nss *NamespaceTable, wl WikiLink) string {
+	sp, ok := nss.SubjectPage(wl)
+	if !ok {
+		return wl.FullPagename()
+	}
+	return sp.FullPagename()
+}
+
+func basePageName(nss *NamespaceTable, wl WikiLink) string {
+	if i := strings.LastIndex(wl.PageName, "/"); i > 0 && nss.hasSubpages(wl.Namespace) {
+		return wl.PageName[:i]
+	}
+	return wl.PageName
+}
+
+func rootPageName(nss *NamespaceTable, wl WikiLink) string {
+	if i := strings.Index(wl.PageName, "/"); i > 0 && nss.hasSubpages(wl.Namespace) {
+		return wl.PageName[:i]
+	}
+	return wl.PageName
+}
+
+func subPageName(nss *NamespaceTable, wl WikiLink) string {
+	if i := strings.LastIndex(wl.PageName, "/"); i >= 0 && nss.hasSubpages(wl.Namespace) {
+		return wl.PageName[i+1:]
+	}
+	return wl.PageName
+}
+
+func mfLc(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return strings.ToLower(arg0)
+}
+
+func mfUc(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return strings.ToUpper(arg0)
+}
+
+func mfLcfirst(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	r, l := utf8.DecodeRuneInString(arg0)
+	if l == 0 {
+		return ""
+	}
+	return string(unicode.ToLower(r)) + arg0[l:]
+}
+
+func mfUcfirst(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return ucfirst(arg0)
+}
+
+func pad(s string, args []*pfArg, left bool) string {
+	length, err := strconv.Atoi(argText(args, 0))
+	if err != nil {
+		return s
+	}
+	if length > 500 {
+		length = 500
+	}
+	padding := "0"
+	if len(args) > 1 {
+		padding = args[1].text()
+	}
+	pr := []rune(padding)
+	n := length - utf8.RuneCountInString(s)
+	if len(pr) == 0 || n <= 0 {
+		return s
+	}
+	p := make([]rune, 0, n)
+	for i := 0; i < n; i++ {
+		p = append(p, pr[i%len(pr)])
+	}
+	if left {
+		return string(p) + s
+	}
+	return s + string(p)
+}
+
+func mfPadleft(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return pad(arg0, args, true)
+}
+
+func mfPadright(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return pad(arg0, args, false)
+}
+
+// phpURLEncode encodes s as PHP's urlencode, or rawurlencode if raw is set.
+func phpURLEncode(s string, raw bool) string {
+	const hex = "0123456789ABCDEF"
+	out := make([]byte, 0, len(s)*3)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+			out = append(out, c)
+		case c == '~' && raw:
+			out = append(out, c)
+		case c == ' ' && !raw:
+			out = append(out, '+')
+		default:
+			out = append(out, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	return string(out)
+}
+
+var wikiURLDecodes = strings.NewReplacer(
+	"%3B", ";", "%40", "@", "%24", "$", "%21", "!", "%2A", "*", "%28", "(",
+	"%29", ")", "%2C", ",", "%2F", "/", "%7E", "~", "%3A", ":",
+)
+
+// wikiURLEncode encodes a title for use in an url, as MediaWiki's
+// wfUrlencode, spaces being replaced by underscores.
+func wikiURLEncode(s string) string {
+	return wikiURLDecodes.Replace(phpURLEncode(strings.Replace(s, " ", "_", -1), false))
+}
+
+func mfUrlencode(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	switch strings.ToUpper(argText(args, 0)) {
+	case "WIKI":
+		return wikiURLEncode(arg0)
+	case "PATH":
+		return phpURLEncode(arg0, true)
+	}
+	return phpURLEncode(arg0, false)
+}
+
+var anchorSpacesRe = regexp.MustCompile(`[ \t\n\r\f_]+`)
+var htmlTagsRe = regexp.MustCompile(`<[^>]*>`)
+
+// anchorEncode turns a section title into the anchor used to link to it.
+func anchorEncode(s string) string {
+	s = html.UnescapeString(htmlTagsRe.ReplaceAllString(s, ""))
+	return strings.Trim(anchorSpacesRe.ReplaceAllString(s, "_"), "_")
+}
+
+func mfAnchorencode(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return anchorEncode(arg0)
+}
+
+var formatNumRe = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)?`)
+
+func commafy(s string) string {
+	ip := s
+	fp := ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		ip, fp = s[:i], s[i:]
+	}
+	out := make([]byte, 0, len(s)+len(s)/3)
+	for i := range ip {
+		if i > 0 && (len(ip)-i)%3 == 0 {
+			out = append(out, ',')
+		}
+		out = append(out, ip[i])
+	}
+	return string(out) + fp
+}
+
+func mfFormatnum(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	switch strings.ToUpper(argText(args, 0)) {
+	case "R":
+		return strings.Replace(arg0, ",", "", -1)
+	case "NOSEP":
+		return arg0
+	}
+	return formatNumRe.ReplaceAllStringFunc(arg0, commafy)
+}
+
+func mfPlural(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if len(args) == 0 {
+		return ""
+	}
+	n, err := strconv.ParseFloat(strings.Replace(arg0, ",", "", -1), 64)
+	if err == nil && n == 1 || len(args) == 1 {
+		return args[0].text()
+	}
+	return args[1].text()
+}
+
+// mfGender returns the neutral form, the gender of users being unknown.
+func mfGender(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if len(args) > 2 {
+		return args[2].text()
+	}
+	return argText(args, 0)
+}
+
+func namespaceByArg(a *Article, arg0 string) string {
+	nss := a.namespaces()
+	if id, err := strconv.Atoi(arg0); err == nil {
+		if ns := nss.ById(id); ns != nil {
+			return ns.Name
+		}
+		return ""
+	}
+	if ns, ok := nss.ByName(canoReSpaces.ReplaceAllString(strings.TrimSpace(arg0), " ")); ok {
+		return ns.Name
+	}
+	return ""
+}
+
+func mfNs(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return namespaceByArg(a, arg0)
+}
+
+func mfNse(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return wikiURLEncode(namespaceByArg(a, arg0))
+}
+
+func (a *Article) localURL(page, query string) string {
+	pc := a.context()
+	wl := a.namespaces().WikiCanonicalFormNamespaceEsc(page, "", true)
+	title := wikiURLEncode(wl.FullPagename())
+	if len(query) == 0 {
+		return strings.Replace(pc.ArticlePath, "$1", title, 1)
+	}
+	return pc.ScriptPath + "/index.php?title=" + title + "&" + query
+}
+
+func mfLocalurl(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return a.localURL(arg0, argText(args, 0))
+}
+
+func mfLocalurle(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return html.EscapeString(a.localURL(arg0, argText(args, 0)))
+}
+
+func mfSpecial(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return "Special:" + mfUcfirst(a, g, arg0, nil)
+}
+
+func mfSpeciale(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return wikiURLEncode(mfSpecial(a, g, arg0, args))
+}
+
+func mfFullurl(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return a.context().Server + a.localURL(arg0, argText(args, 0))
+}
+
+func mfFullurle(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return html.EscapeString(mfFullurl(a, g, arg0, args))
+}
+
+func mfCanonicalurl(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	u := mfFullurl(a, g, arg0, args)
+	if strings.HasPrefix(u, "//") {
+		return "https:" + u
+	}
+	return u
+}
+
+func mfCanonicalurle(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	return html.EscapeString(mfCanonicalurl(a, g, arg0, args))
+}
+
+// mfPagesize returns the size in bytes of the given page, or of the article
+// itself.
+func mfPagesize(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if len(arg0) == 0 {
+		return strconv.Itoa(len(a.MediaWiki))
+	}
+	wl := a.namespaces().WikiCanonicalFormNamespaceEsc(arg0, "", true)
+	if wl.FullPagename() == a.Title || g == nil {
+		return strconv.Itoa(len(a.MediaWiki))
+	}
+	mw, err := g.Get(wl)
+	if err != nil {
+		return "0"
+	}
+	return strconv.Itoa(len(mw))
+}
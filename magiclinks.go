@@ -0,0 +1,168 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Identifier is a book, standard or paper identifier found as a magic
+// link in the text.
+type Identifier struct {
+	Type string // "ISBN", "RFC" or "PMID"
+	Id   string // the identifier, with the spaces and dashes of ISBNs removed
+}
+
+// characters allowed in external links, as in MediaWiki's
+// EXT_LINK_URL_CLASS
+func isURLChar(rv rune) bool {
+	switch rv {
+	case '[', ']', '<', '>', '"', '\x7f', '\ufffd':
+		return false
+	}
+	return rv > ' ' && !unicode.Is(unicode.Zs, rv)
+}
+
+var magicLinkSpaces = `(?:[ \t\n\r\f\v]|&nbsp;|&#0*160;|&#[Xx]0*[Aa]0;|\p{Zs})+`
+var magicLinkRe = regexp.MustCompile(`^(?:(RFC|PMID)` + magicLinkSpaces + `([0-9]+)|(ISBN)` + magicLinkSpaces +
+	`((?:97[89](?:-|` + magicLinkSpaces + `)?)?(?:[0-9](?:-|` + magicLinkSpaces + `)?){9}[0-9Xx]))`)
+var isbnSeparatorsRe = regexp.MustCompile(`-|` + magicLinkSpaces)
+var trailingEntityRe = regexp.MustCompile(`&(?:[A-Za-z0-9]+|#[0-9]+|#x[0-9A-Fa-f]+)$`)
+
+// isWordStart tells if the character at pos in l is not preceded by a
+// letter, a digit or an underscore.
+func isWordStart(l string, pos int) bool {
+	if pos == 0 {
+		return true
+	}
+	rv, _ := utf8.DecodeLastRuneInString(l[:pos])
+	return !(unicode.IsLetter(rv) || unicode.IsDigit(rv) || rv == '_')
+}
+
+// isWordEnd tells if the character at pos in l is not a letter, a digit or
+// an underscore.
+func isWordEnd(l string, pos int) bool {
+	if pos >= len(l) {
+		return true
+	}
+	rv, _ := utf8.DecodeRuneInString(l[pos:])
+	return !(unicode.IsLetter(rv) || unicode.IsDigit(rv) || rv == '_')
+}
+
+// hasScheme tells if l starts with a URL scheme followed by a colon, as
+// all the protocols of free links do. It is cheaper than trying each
+// protocol at the start of every word.
+func hasScheme(l string) bool {
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case c == ':':
+			return i > 0
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '+', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// freeLinkLength returns the length of the free external link at the start
+// of l, or 0. Protocol relative urls are not recognized. As in MediaWiki,
+// trailing punctuation is not part of the link, and neither is a closing
+// parenthesis if the link has no opening one.
+func (a *Article) freeLinkLength(l string) int {
+	if !hasScheme(l) {
+		return 0
+	}
+	proto := 0
+	for _, p := range a.context().URLProtocols {
+		if p != "//" && matchPrefixes(l, []string{p}) {
+			proto = len(p)
+			break
+		}
+	}
+	if proto == 0 {
+		return 0
+	}
+	e := proto
+	for e < len(l) {
+		rv, rl := utf8.DecodeRuneInString(l[e:])
+		if !isURLChar(rv) || strings.HasPrefix(l[e:], "''") {
+			break
+		}
+		e += rl
+	}
+	sep := ",;.:!?"
+	if !strings.Contains(l[:e], "(") {
+		sep += ")"
+	}
+	n := len(l[:e]) - len(strings.TrimRight(l[:e], sep))
+	if n > 0 && l[e-n] == ';' && trailingEntityRe.MatchString(l[:e-n]) {
+		// keep the ; of a trailing html entity
+		n--
+	}
+	e -= n
+	if e <= proto {
+		return 0
+	}
+	return e
+}
+
+// parseFreeLink tokenizes the free external link or the magic link at the
+// start of l.
+func (a *Article) parseFreeLink(l string) (int, []*Token, bool) {
+	if strings.HasPrefix(l, "RFC") || strings.HasPrefix(l, "PMID") || strings.HasPrefix(l, "ISBN") {
+		if m := magicLinkRe.FindStringSubmatchIndex(l); m != nil && isWordEnd(l, m[1]) {
+			kind, id := "", ""
+			if m[2] >= 0 {
+				kind, id = l[m[2]:m[3]], l[m[4]:m[5]]
+			} else {
+				kind, id = l[m[6]:m[7]], strings.ToUpper(isbnSeparatorsRe.ReplaceAllString(l[m[8]:m[9]], ""))
+			}
+			return m[1], []*Token{{TType: "magiclink", TText: l[:m[1]], TAttr: kind, TPipes: []string{id}}}, true
+		}
+	}
+	e := a.freeLinkLength(l)
+	if e == 0 {
+		return 0, nil, false
+	}
+	return e, []*Token{
+		{TType: "extlink", TText: l[:e]},
+		{TType: "text", TText: l[:e]},
+		{TType: "closeextlink"},
+	}, true
+}
+
+// magicLinkURL returns the url a magic link points to. ISBNs link to a
+// local special page.
+func (a *Article) magicLinkURL(kind, id string) (string, bool) {
+	switch kind {
+	case "RFC":
+		return "https://datatracker.ietf.org/doc/html/rfc" + id, true
+	case "PMID":
+		return "//www.ncbi.nlm.nih.gov/pubmed/" + id + "?dopt=Abstract", true
+	}
+	return "", false
+}
+
+// isbnLink returns the link to the book sources page of an ISBN.
+func (a *Article) isbnLink(id string) WikiLink {
+	return a.namespaces().WikiCanonicalFormNamespaceEsc("Special:BookSources/"+id, "", true)
+}
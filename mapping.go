@@ -0,0 +1,428 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mappings are DBpedia style rules turning the parameters of templates,
+// usually infoboxes, into triples about the page.
+type Mappings struct {
+	Templates []TemplateMapping `json:"mappings"`
+}
+
+// TemplateMapping maps the parameters of a template.
+type TemplateMapping struct {
+	Template   string        `json:"template"`
+	Class      string        `json:"class,omitempty"` // class of the subject, if any
+	Properties []MappingRule `json:"properties"`
+}
+
+// MappingRule maps a parameter to a property. Type is one of link, date,
+// number, unit and string. Unit is the unit of the numbers of unit type
+// written without one.
+type MappingRule struct {
+	Parameter string `json:"parameter"`
+	Property  string `json:"property"`
+	Type      string `json:"type"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+// Triple is a statement about the page extracted by the mappings. Value is
+// the normalized value: the full page name of links, the ISO 8601 date,
+// the number or the text.
+type Triple struct {
+	Subject  string
+	Property string
+	Type     string // class, link, date, number, unit or string
+	Value    string
+	Link     *WikiLink // for links
+	Number   float64   // for numbers and units
+	Unit     string    // for units
+}
+
+// MappedParam is a parameter of a mapped template which did not produce a
+// triple.
+type MappedParam struct {
+	Template  string
+	Parameter string
+	Value     string
+}
+
+// MappingReport holds the result of applying mappings to an article.
+type MappingReport struct {
+	Triples  []Triple
+	Unmapped []MappedParam // parameters without a rule
+	Invalid  []MappedParam // values which do not match the type of their rule
+}
+
+var mappingTypes = map[string]bool{"link": true, "date": true, "number": true, "unit": true, "string": true}
+
+// LoadMappings reads mapping rules in JSON or YAML. Only the block style of
+// YAML is supported: mappings, sequences and plain or quoted scalars, with
+// comments; flow collections, anchors and multi-line scalars are not.
+func LoadMappings(r io.Reader) (*Mappings, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimSpace(data); len(t) == 0 || (t[0] != '{' && t[0] != '[') {
+		v, err := parseYAML(string(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	m := &Mappings{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	for _, tm := range m.Templates {
+		for _, r := range tm.Properties {
+			if !mappingTypes[r.Type] {
+				return nil, fmt.Errorf("mapping of %s|%s: unknown type %q", tm.Template, r.Parameter, r.Type)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Apply turns the templates of the article matching the mappings into
+// triples whose subject is the title of the article.
+func (m *Mappings) Apply(a *Article) *MappingReport {
+	nss := a.namespaces()
+	byName := make(map[string]*TemplateMapping, len(m.Templates))
+	for i := range m.Templates {
+		wl := nss.WikiCanonicalFormNamespaceEsc(m.Templates[i].Template, "Template", true)
+		byName[wl.FullPagename()] = &m.Templates[i]
+	}
+	title := nss.WikiCanonicalFormNamespaceEsc(a.Title, "", true)
+	subject := title.FullPagename()
+	report := &MappingReport{Triples: make([]Triple, 0, 8)}
+	for _, t := range a.Templates {
+		if t.Typ != "normal" {
+			continue
+		}
+		wl := nss.WikiCanonicalFormNamespaceEsc(t.Name, "Template", true)
+		tm, ok := byName[wl.FullPagename()]
+		if !ok {
+			continue
+		}
+		if len(tm.Class) > 0 {
+			report.Triples = append(report.Triples, Triple{Subject: subject, Property: "rdf:type", Type: "class", Value: tm.Class})
+		}
+		for i, p := range t.Params {
+			// the value of a template may be empty, e.g. with DummyPageGetter
+			if len(p.source) == 0 {
+				continue
+			}
+			mp := MappedParam{Template: tm.Template, Parameter: p.Name, Value: p.Value}
+			found, valid := false, false
+			for _, r := range tm.Properties {
+				if r.Parameter != p.Name {
+					continue
+				}
+				found = true
+				ts := a.mapValue(a.parseInfoboxParam(p, t.inner[i]), r)
+				for i := range ts {
+					ts[i].Subject = subject
+				}
+				valid = valid || len(ts) > 0
+				report.Triples = append(report.Triples, ts...)
+			}
+			switch {
+			case !found:
+				report.Unmapped = append(report.Unmapped, mp)
+			case !valid:
+				report.Invalid = append(report.Invalid, mp)
+			}
+		}
+	}
+	return report
+}
+
+var mappingNumberRe = regexp.MustCompile(`[-+−]?(?:\d{1,3}(?:,\d{3})+|\d+)(?:\.\d+)?(?:[eE][-+]?\d+)?`)
+var mappingUnitRe = regexp.MustCompile(`^\s*([^\s\d.,;()\[\]]+)`)
+
+// parseMappingNumber returns the first number of s, and the text following
+// it.
+func parseMappingNumber(s string) (float64, string, bool) {
+	loc := mappingNumberRe.FindStringIndex(s)
+	if loc == nil {
+		return 0, "", false
+	}
+	n := strings.Replace(s[loc[0]:loc[1]], ",", "", -1)
+	n = strings.Replace(n, "−", "-", 1)
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return f, s[loc[1]:], true
+}
+
+// dateTemplates are the templates giving a date as their year, month and
+// day positional parameters.
+var dateTemplates = map[string]bool{
+	"Birth date": true, "Birth date and age": true, "Death date": true, "Death date and age": true,
+	"Start date": true, "Start date and age": true, "End date": true, "Film date": true,
+}
+
+// templateDate returns the date given by the first date template of ts.
+// Their rendering is not needed, so that dates are found even when the
+// templates are not available.
+func (a *Article) templateDate(ts []*Template) (CitationDate, bool) {
+	for _, t := range ts {
+		if !dateTemplates[a.namespaces().WikiCanonicalFormNamespaceEsc(t.Name, "Template", true).PageName] {
+			continue
+		}
+		d := CitationDate{}
+		d.Year, _ = strconv.Atoi(strings.TrimSpace(t.Parameters["1"]))
+		if d.Year <= 0 {
+			continue
+		}
+		d.Month, _ = strconv.Atoi(strings.TrimSpace(t.Parameters["2"]))
+		if d.Month < 1 || d.Month > 12 {
+			d.Month = 0
+			return d, true
+		}
+		d.Day, _ = strconv.Atoi(strings.TrimSpace(t.Parameters["3"]))
+		if d.Day < 1 || d.Day > 31 {
+			d.Day = 0
+		}
+		return d, true
+	}
+	return CitationDate{}, false
+}
+
+// mapValue returns the triples for the value of p according to r, without
+// the subject.
+func (a *Article) mapValue(p *InfoboxParam, r MappingRule) []Triple {
+	out := make([]Triple, 0, 1)
+	switch r.Type {
+	case "link":
+		for i := range p.Links {
+			l := p.Links[i]
+			out = append(out, Triple{Property: r.Property, Type: r.Type, Value: l.FullPagename(), Link: &l})
+		}
+	case "date":
+		if d, ok := a.templateDate(p.Templates); ok {
+			out = append(out, Triple{Property: r.Property, Type: r.Type, Value: d.iso()})
+		} else if d := parseCitationDate(p.Text); d.Year > 0 {
+			out = append(out, Triple{Property: r.Property, Type: r.Type, Value: d.iso()})
+		}
+	case "number", "unit":
+		f, rest, ok := parseMappingNumber(p.Text)
+		if !ok {
+			break
+		}
+		t := Triple{Property: r.Property, Type: r.Type, Value: strconv.FormatFloat(f, 'f', -1, 64), Number: f}
+		if r.Type == "unit" {
+			t.Unit = r.Unit
+			if m := mappingUnitRe.FindStringSubmatch(rest); m != nil {
+				t.Unit = m[1]
+			}
+			if len(t.Unit) == 0 {
+				break
+			}
+		}
+		out = append(out, t)
+	case "string":
+		if len(p.Text) > 0 {
+			out = append(out, Triple{Property: r.Property, Type: r.Type, Value: p.Text})
+		}
+	}
+	return out
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// stripYAMLComment removes the comment at the end of a line, if not quoted.
+func stripYAMLComment(l string) string {
+	quote := rune(0)
+	for i, rv := range l {
+		switch {
+		case quote != 0:
+			if rv == quote {
+				quote = 0
+			}
+		case rv == '"' || rv == '\'':
+			quote = rv
+		case rv == '#' && (i == 0 || l[i-1] == ' '):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+// parseYAML decodes the supported subset of YAML, the scalars being
+// returned as strings.
+func parseYAML(s string) (interface{}, error) {
+	p := &yamlParser{}
+	for i, l := range strings.Split(s, "\n") {
+		l = strings.TrimRight(stripYAMLComment(l), " \t\r")
+		t := strings.TrimLeft(l, " ")
+		if len(t) == 0 || t == "---" {
+			continue
+		}
+		if t[0] == '\t' {
+			return nil, fmt.Errorf("yaml line %d: tab in indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(l) - len(t), text: t})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseBlock(p.lines[0].indent)
+	if err == nil && p.pos < len(p.lines) {
+		err = p.errorf("unexpected indentation")
+	}
+	return v, err
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	num := 0
+	if p.pos < len(p.lines) {
+		num = p.lines[p.pos].num
+	}
+	return errors.New("yaml line " + strconv.Itoa(num) + ": " + fmt.Sprintf(format, args...))
+}
+
+func isYAMLItem(t string) bool {
+	return t == "-" || strings.HasPrefix(t, "- ")
+}
+
+// splitYAMLKey splits a mapping entry in key and value.
+func splitYAMLKey(t string) (string, string, bool) {
+	i := strings.Index(t, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(t, ":") {
+			return "", "", false
+		}
+		i = len(t) - 1
+	}
+	key, err := yamlScalar(strings.TrimSpace(t[:i]))
+	if err != nil {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(t[i+1:]), true
+}
+
+func yamlScalar(t string) (string, error) {
+	switch {
+	case len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"':
+		return strconv.Unquote(t)
+	case len(t) >= 2 && t[0] == '\'' && t[len(t)-1] == '\'':
+		return strings.Replace(t[1:len(t)-1], "''", "'", -1), nil
+	case len(t) > 0 && (t[0] == '[' || t[0] == '{' || t[0] == '&' || t[0] == '*' || t[0] == '|' || t[0] == '>'):
+		return "", errors.New("unsupported yaml syntax " + t)
+	}
+	return t, nil
+}
+
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	out := make([]interface{}, 0, 2)
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+		l := &p.lines[p.pos]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if len(rest) == 0 {
+			p.pos++
+			var v interface{}
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				var err error
+				if v, err = p.parseBlock(p.lines[p.pos].indent); err != nil {
+					return nil, err
+				}
+			}
+			out = append(out, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok || isYAMLItem(rest) {
+			// the item is a block starting on the same line
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			v, err := p.parseBlock(l.indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		v, err := yamlScalar(rest)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		out = append(out, v)
+		p.pos++
+	}
+	return out, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	out := make(map[string]interface{})
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && !isYAMLItem(p.lines[p.pos].text) {
+		key, value, ok := splitYAMLKey(p.lines[p.pos].text)
+		if !ok {
+			return nil, p.errorf("expected a key")
+		}
+		p.pos++
+		var v interface{}
+		var err error
+		switch {
+		case len(value) > 0:
+			if v, err = yamlScalar(value); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			v, err = p.parseBlock(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text):
+			// sequences may have the indentation of their key
+			v, err = p.parseSequence(indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,411 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MarkdownOptions configures RenderMarkdown. Nil functions get default
+// implementations.
+type MarkdownOptions struct {
+	// LinkURL returns the url of an internal link. By default it is built
+	// from the article path of the page context.
+	LinkURL func(wl WikiLink) string
+	// ImageURL returns the url of the image of a file link. By default
+	// images are rendered as links to their file page.
+	ImageURL func(wl WikiLink) string
+}
+
+type mdRenderer struct {
+	a    *Article
+	opts MarkdownOptions
+}
+
+// RenderMarkdown writes a (GitHub flavored) Markdown rendering of the parse
+// tree of the article to w. References are rendered as footnotes.
+func (a *Article) RenderMarkdown(w io.Writer, opts *MarkdownOptions) error {
+	r := &mdRenderer{a: a}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.LinkURL == nil {
+		r.opts.LinkURL = a.defaultLinkURL
+	}
+	var blocks []string
+	if a.Root != nil {
+		blocks = r.blocks(a.Root.Nodes)
+	}
+	if notes := r.footnotes(nil); notes != "" {
+		blocks = append(blocks, notes)
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, strings.Join(blocks, "\n\n")+"\n")
+	return err
+}
+
+var mdLineStartRe = regexp.MustCompile(`^(?:[#>+=-]|\d+[.)])`)
+var mdEntityRe = regexp.MustCompile(`&(#?[0-9A-Za-z]+;)`)
+
+// escapeMarkdown backslash escapes the Markdown metacharacters of s. Line
+// start markers are only escaped when s starts a line.
+func escapeMarkdown(s string, lineStart bool) string {
+	var b strings.Builder
+	for _, rv := range s {
+		switch rv {
+		case '\\', '`', '*', '_', '[', ']', '<', '>', '|', '~':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(rv)
+	}
+	s = mdEntityRe.ReplaceAllString(b.String(), `\&$1`)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if i == 0 && !lineStart {
+			continue
+		}
+		if m := mdLineStartRe.FindStringIndex(strings.TrimLeft(l, " ")); m != nil {
+			p := len(l) - len(strings.TrimLeft(l, " ")) + m[1] - 1
+			lines[i] = l[:p] + `\` + l[p:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mdURL escapes the characters that would end a Markdown link destination.
+func mdURL(u string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E").Replace(u)
+}
+
+func atLineStart(b *strings.Builder) bool {
+	s := b.String()
+	return len(strings.TrimRight(s, " ")) == 0 || strings.HasSuffix(strings.TrimRight(s, " "), "\n")
+}
+
+func isMdBlock(n *ParseNode) bool {
+	switch n.NType {
+	case "break", "redirect", "gallery", "references":
+		return true
+	case "html":
+		return htmlBlockTags[n.NSubType]
+	}
+	return false
+}
+
+// blocks renders a sequence of nodes as Markdown blocks, grouping runs of
+// inline nodes into paragraphs.
+func (r *mdRenderer) blocks(nodes []*ParseNode) []string {
+	out := make([]string, 0, 4)
+	para := new(strings.Builder)
+	flush := func() {
+		lines := strings.Split(para.String(), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		if p := strings.Trim(strings.Join(lines, "\n"), "\n"); p != "" {
+			out = append(out, p)
+		}
+		para.Reset()
+	}
+	for _, n := range nodes {
+		if !isMdBlock(n) {
+			r.inline(n, para, false)
+			continue
+		}
+		flush()
+		if s := r.block(n); s != "" {
+			out = append(out, s)
+		}
+	}
+	flush()
+	return out
+}
+
+func (r *mdRenderer) block(n *ParseNode) string {
+	if n.NType == "redirect" {
+		return "Redirect to [" + escapeMarkdown(n.Link.FullPagenameAnchor(), false) + "](" + mdURL(r.opts.LinkURL(n.Link)) + ")"
+	}
+	switch n.NType {
+	case "gallery":
+		return r.gallery(n)
+	case "references":
+		return r.footnotes(n)
+	}
+	switch n.NSubType {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(n.NSubType[1:])
+		return strings.Repeat("#", level) + " " + r.inlineText(n.Nodes, true)
+	case "hr":
+		return "---"
+	case "pre":
+		text, _ := r.a.genNodesText(n.Nodes)
+		text = strings.Trim(text, "\n")
+		fence := "```"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		return fence + "\n" + text + "\n" + fence
+	case "ul", "ol", "dl":
+		return strings.TrimRight(r.list(n, ""), "\n")
+	case "table":
+		return r.table(n)
+	case "blockquote":
+		lines := strings.Split(strings.Join(r.blocks(n.Nodes), "\n\n"), "\n")
+		for i, l := range lines {
+			lines[i] = strings.TrimRight("> "+l, " ")
+		}
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(r.blocks(n.Nodes), "\n\n")
+}
+
+// gallery renders a gallery as a list of images, each followed by its
+// caption when the images are shown.
+func (r *mdRenderer) gallery(n *ParseNode) string {
+	lines := make([]string, 0, len(n.Nodes)+1)
+	if caption := parseAttributes(n.Contents)["caption"]; len(caption) > 0 {
+		lines = append(lines, escapeMarkdown(caption, true))
+	}
+	for _, c := range n.Nodes {
+		if c.NType != "image" {
+			continue
+		}
+		b := new(strings.Builder)
+		r.inline(c, b, false)
+		if r.opts.ImageURL != nil && len(c.Nodes) > 0 {
+			b.WriteString(" " + r.inlineText(c.Nodes, false))
+		}
+		lines = append(lines, "- "+b.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// inlineText renders nodes on a single line.
+func (r *mdRenderer) inlineText(nodes []*ParseNode, table bool) string {
+	b := new(strings.Builder)
+	for _, n := range nodes {
+		r.inline(n, b, table)
+	}
+	return strings.TrimSpace(strings.Join(strings.Fields(b.String()), " "))
+}
+
+func (r *mdRenderer) inline(n *ParseNode, b *strings.Builder, table bool) {
+	switch n.NType {
+	case "text":
+		b.WriteString(escapeMarkdown(n.Contents, atLineStart(b)))
+	case "space":
+		b.WriteString(" ")
+	case "math":
+		b.WriteString(codeSpan(n.Contents))
+	case "link":
+		text := r.inlineText(n.Nodes, table)
+		if text == "" {
+			text = escapeMarkdown(n.Link.FullPagenameAnchor(), false)
+		}
+		b.WriteString("[" + text + "](" + mdURL(r.opts.LinkURL(n.Link)) + ")")
+	case "extlink":
+		text := r.inlineText(n.Nodes, table)
+		switch {
+		case !r.a.isExtLink(n.Contents):
+			b.WriteString(escapeMarkdown("["+n.Contents+" ", false) + text + `\]`)
+		case text == "":
+			b.WriteString("<" + mdURL(n.Contents) + ">")
+		default:
+			b.WriteString("[" + text + "](" + mdURL(n.Contents) + ")")
+		}
+	case "magiclink":
+		u, ok := r.a.magicLinkURL(n.NSubType, n.Contents)
+		if !ok {
+			u = r.opts.LinkURL(r.a.isbnLink(n.Contents))
+		}
+		b.WriteString("[" + r.inlineText(n.Nodes, table) + "](" + mdURL(u) + ")")
+	case "image":
+		text := r.inlineText(n.Nodes, table)
+		if r.opts.ImageURL != nil {
+			b.WriteString("![" + text + "](" + mdURL(r.opts.ImageURL(n.Link)) + ")")
+			return
+		}
+		if text == "" {
+			text = escapeMarkdown(n.Link.FullPagename(), false)
+		}
+		b.WriteString("[" + text + "](" + mdURL(r.opts.LinkURL(n.Link)) + ")")
+	case "ref":
+		if u, ok := r.a.refUses[n]; ok {
+			b.WriteString("[^" + strconv.Itoa(u.ref.index) + "]")
+		}
+	case "references":
+		// only the notes are output, in block context
+	case "html":
+		r.inlineHTML(n, b, table)
+	case "break", "redirect":
+		b.WriteString("\n\n")
+	default:
+		for _, c := range n.Nodes {
+			r.inline(c, b, table)
+		}
+	}
+}
+
+func (r *mdRenderer) inlineHTML(n *ParseNode, b *strings.Builder, table bool) {
+	switch n.NSubType {
+	case "b", "strong", "i", "em":
+		text := r.inlineText(n.Nodes, table)
+		if text == "" {
+			return
+		}
+		mark := "**"
+		if n.NSubType == "i" || n.NSubType == "em" {
+			mark = "*"
+		}
+		b.WriteString(mark + text + mark)
+	case "br":
+		if table {
+			b.WriteString(" ")
+		} else {
+			b.WriteString("\\\n")
+		}
+	case "pre", "code", "tt", "kbd", "samp":
+		text, _ := r.a.genNodesText(n.Nodes)
+		b.WriteString(codeSpan(text))
+	default:
+		if isMdBlock(n) {
+			if table {
+				b.WriteString(" " + strings.Join(strings.Fields(r.block(n)), " ") + " ")
+			} else {
+				b.WriteString("\n\n" + r.block(n) + "\n\n")
+			}
+			return
+		}
+		for _, c := range n.Nodes {
+			r.inline(c, b, table)
+		}
+	}
+}
+
+// codeSpan returns s as an inline code span.
+func codeSpan(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	fence := "`"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+func (r *mdRenderer) list(n *ParseNode, indent string) string {
+	var b strings.Builder
+	num := 0
+	for _, item := range n.Nodes {
+		if item.NType != "html" {
+			continue
+		}
+		var marker string
+		switch item.NSubType {
+		case "li":
+			marker = "- "
+			if n.NSubType == "ol" {
+				num++
+				marker = strconv.Itoa(num) + ". "
+			}
+		case "dd":
+			marker = ": "
+		case "dt":
+			marker = ""
+		default:
+			b.WriteString(r.list(item, indent))
+			continue
+		}
+		inline := make([]*ParseNode, 0, len(item.Nodes))
+		var nested []*ParseNode
+		for _, c := range item.Nodes {
+			if c.NType == "html" && (c.NSubType == "ul" || c.NSubType == "ol" || c.NSubType == "dl") {
+				nested = append(nested, c)
+			} else {
+				inline = append(inline, c)
+			}
+		}
+		text := r.inlineText(inline, false)
+		if item.NSubType == "dt" && text != "" {
+			text = "**" + text + "**"
+		}
+		if text != "" || len(nested) == 0 {
+			b.WriteString(indent + marker + text + "\n")
+		}
+		for _, c := range nested {
+			b.WriteString(r.list(c, indent+strings.Repeat(" ", len(marker))))
+		}
+	}
+	return b.String()
+}
+
+func (r *mdRenderer) table(n *ParseNode) string {
+	// Markdown has no spans: lay the cells out on the grid of GetTables and
+	// repeat a spanning cell in every position it covers
+	t := r.a.newTable(n)
+	var b strings.Builder
+	if t.CaptionNodes != nil {
+		if caption := r.inlineText(t.CaptionNodes, true); caption != "" {
+			b.WriteString(caption + "\n\n")
+		}
+	}
+	if len(t.Rows) == 0 || len(t.Rows[0]) == 0 {
+		return strings.TrimSpace(b.String())
+	}
+	cols := len(t.Rows[0])
+	texts := make(map[*TableCell]string)
+	for i, cells := range t.Rows {
+		row := make([]string, cols)
+		for j, c := range cells {
+			if c == nil {
+				continue
+			}
+			text, ok := texts[c]
+			if !ok {
+				text = r.inlineText(c.Node.Nodes, true)
+				texts[c] = text
+			}
+			row[j] = text
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|" + strings.Repeat(" --- |", cols) + "\n")
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// footnotes renders the footnotes listed by the references node n, or
+// those left for the end of the page if n is nil.
+func (r *mdRenderer) footnotes(n *ParseNode) string {
+	refs := r.a.listedReferences(n)
+	lines := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Node == nil {
+			continue
+		}
+		lines = append(lines, "[^"+strconv.Itoa(ref.index)+"]: "+r.inlineText(ref.Node.Nodes, false))
+	}
+	return strings.Join(lines, "\n")
+}
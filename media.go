@@ -0,0 +1,203 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MediaOptions are the options of a file link, e.g. the options of
+// [[File:X.jpg|thumb|left|200px|alt=A cat|A caption]]. The option keywords
+// are the English ones and those of PageContext.MediaKeywords.
+type MediaOptions struct {
+	Type    string  // "thumb", "frame", "frameless" or empty
+	Thumb   string  // file used as thumbnail, set by thumb=...
+	Border  bool    // true if the image has a border
+	Align   string  // "left", "right", "center", "none" or empty
+	VAlign  string  // vertical alignment, e.g. "middle" or "text-top"
+	Width   int     // width in pixels, 0 if not set
+	Height  int     // height in pixels, 0 if not set
+	Upright float64 // scale of the default thumbnail width, 0 if not set
+	Alt     string  // alternative text
+	Link    string  // target of the link of the image, if HasLink
+	HasLink bool    // true if link=... was given
+	Page    int     // page of multipage files, 0 if not set
+	Lang    string  // language of multilingual SVG files
+	Class   string  // css class of the image
+	Caption []*ParseNode
+}
+
+// DefaultMediaKeywords are the English names of the options of file links,
+// $1 standing for the value of the option.
+var DefaultMediaKeywords = map[string][]string{
+	"thumb":       {"thumb", "thumbnail"},
+	"manualthumb": {"thumbnail=$1", "thumb=$1"},
+	"frame":       {"frame", "framed", "enframed"},
+	"frameless":   {"frameless"},
+	"border":      {"border"},
+	"left":        {"left"},
+	"right":       {"right"},
+	"center":      {"center", "centre"},
+	"none":        {"none"},
+	"baseline":    {"baseline"},
+	"sub":         {"sub"},
+	"super":       {"super", "sup"},
+	"top":         {"top"},
+	"text-top":    {"text-top"},
+	"middle":      {"middle"},
+	"bottom":      {"bottom"},
+	"text-bottom": {"text-bottom"},
+	"upright":     {"upright", "upright=$1", "upright $1"},
+	"width":       {"$1px"},
+	"page":        {"page=$1", "page $1"},
+	"link":        {"link=$1"},
+	"alt":         {"alt=$1"},
+	"lang":        {"lang=$1"},
+	"class":       {"class=$1"},
+}
+
+// default upright factor, as MediaWiki's $wgThumbUpright
+const defaultUpright = 0.75
+
+// matchMediaKeywords returns the options segment s can stand for, with
+// their values, sorted by option.
+func matchMediaKeywords(keywords map[string][]string, s string) [][2]string {
+	out := make([][2]string, 0, 1)
+	for option, names := range keywords {
+		for _, name := range names {
+			i := strings.Index(name, "$1")
+			if i < 0 {
+				if strings.EqualFold(s, name) {
+					out = append(out, [2]string{option, ""})
+				}
+				continue
+			}
+			prefix, suffix := name[:i], name[i+2:]
+			if len(s) >= len(prefix)+len(suffix) && strings.EqualFold(s[:len(prefix)], prefix) &&
+				strings.EqualFold(s[len(s)-len(suffix):], suffix) {
+				out = append(out, [2]string{option, strings.TrimSpace(s[len(prefix) : len(s)-len(suffix)])})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// parseSize decodes the value of a width option: "200", "x100" or
+// "200x100".
+func parseSize(v string) (int, int, bool) {
+	ws, hs := v, ""
+	if i := strings.IndexAny(v, "xX"); i >= 0 {
+		ws, hs = v[:i], v[i+1:]
+	}
+	w, h := 0, 0
+	var err error
+	if len(ws) > 0 {
+		if w, err = strconv.Atoi(strings.TrimSpace(ws)); err != nil || w < 0 {
+			return 0, 0, false
+		}
+	}
+	if len(hs) > 0 {
+		if h, err = strconv.Atoi(strings.TrimSpace(hs)); err != nil || h < 0 {
+			return 0, 0, false
+		}
+	}
+	return w, h, len(ws) > 0 || len(hs) > 0
+}
+
+// applyMediaOption sets option to value in opts. It returns false, leaving
+// opts unchanged, if the value is not valid.
+func (opts *MediaOptions) applyMediaOption(option, value string) bool {
+	switch option {
+	case "thumb", "frame", "frameless":
+		opts.Type = option
+	case "manualthumb":
+		opts.Type = "thumb"
+		opts.Thumb = value
+	case "border":
+		opts.Border = true
+	case "left", "right", "center", "none":
+		opts.Align = option
+	case "baseline", "sub", "super", "top", "text-top", "middle", "bottom", "text-bottom":
+		opts.VAlign = option
+	case "upright":
+		if len(value) == 0 {
+			opts.Upright = defaultUpright
+			return true
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f <= 0 {
+			return false
+		}
+		opts.Upright = f
+	case "width":
+		w, h, ok := parseSize(value)
+		if !ok {
+			return false
+		}
+		opts.Width, opts.Height = w, h
+	case "page":
+		p, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		opts.Page = p
+	case "link":
+		opts.Link = value
+		opts.HasLink = true
+	case "alt":
+		opts.Alt = value
+	case "lang":
+		opts.Lang = value
+	case "class":
+		opts.Class = value
+	}
+	return true
+}
+
+// galleryMediaOptions are the options recognized in the lines of a gallery,
+// the other segments are captions.
+var galleryMediaOptions = map[string]bool{"alt": true, "link": true, "page": true, "lang": true, "class": true}
+
+// parseMediaOptions decodes the pipe separated segments of a file link. It
+// returns the options and the index of the caption, the last segment which
+// is not an option, or -1 if there is none.
+func (a *Article) parseMediaOptions(segments []string, gallery bool) (*MediaOptions, int) {
+	opts := &MediaOptions{}
+	caption := -1
+	local := a.context().MediaKeywords
+	for i, seg := range segments {
+		s := strings.TrimSpace(seg)
+		matches := append(matchMediaKeywords(local, s), matchMediaKeywords(DefaultMediaKeywords, s)...)
+		applied := false
+		for _, m := range matches {
+			if gallery && !galleryMediaOptions[m[0]] {
+				continue
+			}
+			if opts.applyMediaOption(m[0], m[1]) {
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			caption = i
+		}
+	}
+	return opts, caption
+}
@@ -0,0 +1,442 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Namespace describes a namespace of a wiki.
+type Namespace struct {
+	Id            int
+	Name          string   // local name, e.g. "Datei" on the German Wikipedia
+	CanonicalName string   // name valid on every wiki, e.g. "File"
+	Aliases       []string // other accepted names, e.g. "Image"
+	CaseSensitive bool     // false if the first letter of titles is capitalized
+	Content       bool     // true for the namespaces holding articles
+	Subpages      bool     // true if "/" separates subpages
+}
+
+// Namespaces maps the lowercase names of the namespaces of a wiki to their
+// proper names. NamespaceTable holds the full description of the
+// namespaces, Table converts a Namespaces map into one.
+type Namespaces map[string]string
+
+// NamespaceTable describes the namespaces of a wiki, indexed by name and by
+// id.
+type NamespaceTable struct {
+	names map[string]*Namespace // lowercase names, canonical names and aliases
+	ids   map[int]*Namespace
+}
+
+// canonical names of the MediaWiki core namespaces
+var canonicalNamespaceNames = map[int]string{
+	-2: "Media",
+	-1: "Special",
+	0:  "",
+	1:  "Talk",
+	2:  "User",
+	3:  "User talk",
+	4:  "Project",
+	5:  "Project talk",
+	6:  "File",
+	7:  "File talk",
+	8:  "MediaWiki",
+	9:  "MediaWiki talk",
+	10: "Template",
+	11: "Template talk",
+	12: "Help",
+	13: "Help talk",
+	14: "Category",
+	15: "Category talk",
+}
+
+// aliases defined by MediaWiki's default $wgNamespaceAliases
+var defaultNamespaceAliases = map[int][]string{
+	6: {"Image"},
+	7: {"Image talk"},
+}
+
+// DefaultNamespace returns the description of namespace id named name with
+// the MediaWiki defaults: canonical name and aliases of the core
+// namespaces, first-letter case, only the main namespace holding content
+// and subpages everywhere but in the main, File and Category namespaces.
+func DefaultNamespace(id int, name string) Namespace {
+	canonical, ok := canonicalNamespaceNames[id]
+	if !ok {
+		canonical = name
+	}
+	ns := Namespace{
+		Id:            id,
+		Name:          name,
+		CanonicalName: canonical,
+		Aliases:       defaultNamespaceAliases[id],
+		Content:       id == 0,
+	}
+	switch id {
+	case -2, -1, 0, 6, 14:
+	default:
+		ns.Subpages = true
+	}
+	return ns
+}
+
+// NewNamespaceTable builds the namespace table of a wiki from the
+// description of its namespaces. When several namespaces share a name or an
+// id, the first one in list wins.
+func NewNamespaceTable(list []Namespace) *NamespaceTable {
+	out := &NamespaceTable{
+		names: make(map[string]*Namespace),
+		ids:   make(map[int]*Namespace),
+	}
+	for i := range list {
+		ns := list[i]
+		ns.Aliases = append([]string(nil), ns.Aliases...)
+		if _, ok := out.ids[ns.Id]; !ok {
+			out.ids[ns.Id] = &ns
+		}
+		names := append([]string{ns.Name, ns.CanonicalName}, ns.Aliases...)
+		for _, name := range names {
+			if len(name) == 0 && ns.Id != 0 {
+				continue
+			}
+			key := strings.ToLower(canoReSpaces.ReplaceAllString(name, " "))
+			if _, ok := out.names[key]; !ok {
+				out.names[key] = &ns
+			}
+		}
+	}
+	return out
+}
+
+// Table returns the namespace table of the namespaces. The namespaces known
+// to StandardNamespaceTable keep their id and description; the other ones
+// have subpages but no id of their own: their Id is 0, they have no talk
+// pages and ById does not return them.
+func (namespaces Namespaces) Table() *NamespaceTable {
+	list := []Namespace{DefaultNamespace(0, "")}
+	index := make(map[string]int)
+	keys := make([]string, 0, len(namespaces))
+	for key := range namespaces {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := namespaces[key]
+		if len(name) == 0 {
+			continue
+		}
+		i, ok := index[name]
+		if !ok {
+			ns := Namespace{Name: name, CanonicalName: name, Subpages: true}
+			if std, ok := StandardNamespaceTable.ByName(name); ok && std.Id != 0 {
+				ns = *std
+				ns.Name = name
+				ns.Aliases = nil
+			}
+			i = len(list)
+			index[name] = i
+			list = append(list, ns)
+		}
+		if key != strings.ToLower(name) {
+			list[i].Aliases = append(list[i].Aliases, key)
+		}
+	}
+	// the main namespace comes first and keeps id 0
+	return NewNamespaceTable(list)
+}
+
+// lookup returns the description of the namespace named name, the one of
+// StandardNamespaceTable if it is a standard namespace.
+func (namespaces Namespaces) lookup(name string) (*Namespace, bool) {
+	proper, ok := namespaces[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	if ns, ok := StandardNamespaceTable.ByName(proper); ok && ns.Name == proper {
+		return ns, true
+	}
+	return &Namespace{Name: proper, CanonicalName: proper, Subpages: true}, true
+}
+
+// Namespaces returns the lowercase names, canonical names and aliases of the
+// namespaces of the table mapped to their proper names.
+func (nt *NamespaceTable) Namespaces() Namespaces {
+	out := make(Namespaces, len(nt.names))
+	for key, ns := range nt.names {
+		out[key] = ns.Name
+	}
+	return out
+}
+
+// ByName returns the namespace named name, ignoring case, with its local
+// name, canonical name or one of its aliases.
+func (nt *NamespaceTable) ByName(name string) (*Namespace, bool) {
+	ns, ok := nt.names[strings.ToLower(name)]
+	return ns, ok
+}
+
+// ById returns the namespace with the given id, or nil if there is none.
+func (nt *NamespaceTable) ById(id int) *Namespace {
+	return nt.ids[id]
+}
+
+// hasId tells if ns is the namespace of its id in the table.
+func (nt *NamespaceTable) hasId(ns *Namespace) bool {
+	return nt.ids[ns.Id] == ns
+}
+
+// pageIn returns the link to page wl in namespace id.
+func (nt *NamespaceTable) pageIn(wl WikiLink, id int) (WikiLink, bool) {
+	ns := nt.ById(id)
+	if ns == nil {
+		return WikiLink{}, false
+	}
+	return WikiLink{Namespace: ns.Name, NamespaceId: ns.Id, PageName: wl.PageName}, true
+}
+
+// TalkPage returns the talk page associated to the page wl, e.g. "Talk:X"
+// for "X" or "User talk:Y" for "User:Y". Talk pages are their own talk
+// pages. It returns false for the pages of the Special and Media
+// namespaces, which have none, and for namespaces not in the table.
+func (nt *NamespaceTable) TalkPage(wl WikiLink) (WikiLink, bool) {
+	ns, ok := nt.ByName(wl.Namespace)
+	if !ok || ns.Id < 0 || !nt.hasId(ns) {
+		return WikiLink{}, false
+	}
+	return nt.pageIn(wl, ns.Id|1)
+}
+
+// SubjectPage returns the subject page associated to the page wl, e.g. "X"
+// for "Talk:X" or "User:Y" for "User talk:Y". Subject pages are their own
+// subject pages. It returns false for namespaces not in the table.
+func (nt *NamespaceTable) SubjectPage(wl WikiLink) (WikiLink, bool) {
+	ns, ok := nt.ByName(wl.Namespace)
+	if !ok || !nt.hasId(ns) {
+		return WikiLink{}, false
+	}
+	if ns.Id < 0 {
+		return nt.pageIn(wl, ns.Id)
+	}
+	return nt.pageIn(wl, ns.Id&^1)
+}
+
+// hasSubpages tells if "/" separates subpages in namespace ns.
+func (nt *NamespaceTable) hasSubpages(ns string) bool {
+	n, ok := nt.ByName(ns)
+	return ok && n.Subpages
+}
+
+// siteinfoNamespaces accumulates the namespaces and aliases of a siteinfo
+// description, in either format.
+type siteinfoNamespaces struct {
+	list    []Namespace
+	aliases map[int][]string
+}
+
+func (s *siteinfoNamespaces) add(id int, name string, attrs map[string]string) {
+	ns := DefaultNamespace(id, name)
+	if c, ok := attrs["canonical"]; ok {
+		ns.CanonicalName = c
+	}
+	if c, ok := attrs["case"]; ok {
+		ns.CaseSensitive = c == "case-sensitive"
+	}
+	// the API marks flags by the presence of the attribute
+	if _, ok := attrs["content"]; ok {
+		ns.Content = attrs["content"] != "false"
+	}
+	if _, ok := attrs["subpages"]; ok {
+		ns.Subpages = attrs["subpages"] != "false"
+	}
+	s.list = append(s.list, ns)
+}
+
+func (s *siteinfoNamespaces) table() (*NamespaceTable, error) {
+	if len(s.list) == 0 {
+		return nil, fmt.Errorf("No namespaces in siteinfo")
+	}
+	for i := range s.list {
+		s.list[i].Aliases = append(s.list[i].Aliases, s.aliases[s.list[i].Id]...)
+	}
+	return NewNamespaceTable(s.list), nil
+}
+
+// NewNamespaceTableFromXML builds the namespace table from a siteinfo
+// description in XML, either the siteinfo block at the start of a dump or
+// the answer of the API (action=query&meta=siteinfo&siprop=namespaces|namespacealiases&format=xml).
+func NewNamespaceTableFromXML(r io.Reader) (*NamespaceTable, error) {
+	s := &siteinfoNamespaces{aliases: make(map[int][]string)}
+	dec := xml.NewDecoder(r)
+	section := ""
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "namespaces", "namespacealiases":
+			section = se.Name.Local
+			continue
+		case "namespace", "ns":
+		case "page":
+			// the pages of a dump follow the siteinfo block
+			return s.table()
+		default:
+			continue
+		}
+		var e struct {
+			Attrs []xml.Attr `xml:",any,attr"`
+			Text  string     `xml:",chardata"`
+		}
+		if err := dec.DecodeElement(&e, &se); err != nil {
+			return nil, err
+		}
+		attrs := make(map[string]string)
+		for _, a := range e.Attrs {
+			attrs[a.Name.Local] = a.Value
+		}
+		ids, ok := attrs["key"]
+		if !ok {
+			ids = attrs["id"]
+		}
+		id, err := strconv.Atoi(ids)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace id %q", ids)
+		}
+		if section == "namespacealiases" {
+			s.aliases[id] = append(s.aliases[id], e.Text)
+		} else {
+			s.add(id, e.Text, attrs)
+		}
+	}
+	return s.table()
+}
+
+type jsonSiteinfo struct {
+	Query            *jsonSiteinfo                         `json:"query"`
+	Namespaces       map[string]map[string]json.RawMessage `json:"namespaces"`
+	NamespaceAliases []map[string]json.RawMessage          `json:"namespacealiases"`
+}
+
+// jsonString returns the value of a siteinfo JSON property as a string.
+// Flags are true as booleans (formatversion=2) and the empty string
+// otherwise.
+func jsonString(v json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s
+	}
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil && !b {
+		return "false"
+	}
+	return strings.Trim(string(v), `"`)
+}
+
+// NewNamespaceTableFromJSON builds the namespace table from the answer of the
+// API (action=query&meta=siteinfo&siprop=namespaces|namespacealiases&format=json),
+// in either format version.
+func NewNamespaceTableFromJSON(r io.Reader) (*NamespaceTable, error) {
+	var si jsonSiteinfo
+	if err := json.NewDecoder(r).Decode(&si); err != nil {
+		return nil, err
+	}
+	if si.Query != nil {
+		si = *si.Query
+	}
+	s := &siteinfoNamespaces{aliases: make(map[int][]string)}
+	for _, a := range si.NamespaceAliases {
+		id, err := strconv.Atoi(jsonString(a["id"]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace alias id %s", a["id"])
+		}
+		name := jsonString(a["alias"])
+		if v, ok := a["*"]; ok {
+			name = jsonString(v)
+		}
+		s.aliases[id] = append(s.aliases[id], name)
+	}
+	for key, props := range si.Namespaces {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace id %q", key)
+		}
+		attrs := make(map[string]string)
+		for k, v := range props {
+			attrs[k] = jsonString(v)
+		}
+		name, ok := attrs["name"]
+		if !ok {
+			name = attrs["*"]
+		}
+		s.add(id, name, attrs)
+	}
+	return s.table()
+}
+
+// StandardNamespaceTable describes the namespaces of the English Wikipedia.
+var StandardNamespaceTable = NewNamespaceTable([]Namespace{
+	DefaultNamespace(-2, "Media"),
+	DefaultNamespace(-1, "Special"),
+	DefaultNamespace(0, ""),
+	DefaultNamespace(1, "Talk"),
+	DefaultNamespace(2, "User"),
+	DefaultNamespace(3, "User talk"),
+	DefaultNamespace(4, "Wikipedia"),
+	DefaultNamespace(5, "Wikipedia talk"),
+	DefaultNamespace(6, "File"),
+	DefaultNamespace(7, "File talk"),
+	DefaultNamespace(8, "MediaWiki"),
+	DefaultNamespace(9, "MediaWiki talk"),
+	DefaultNamespace(10, "Template"),
+	DefaultNamespace(11, "Template talk"),
+	DefaultNamespace(12, "Help"),
+	DefaultNamespace(13, "Help talk"),
+	DefaultNamespace(14, "Category"),
+	DefaultNamespace(15, "Category talk"),
+	DefaultNamespace(100, "Portal"),
+	DefaultNamespace(101, "Portal talk"),
+	DefaultNamespace(108, "Book"),
+	DefaultNamespace(109, "Book talk"),
+	DefaultNamespace(118, "Draft"),
+	DefaultNamespace(119, "Draft talk"),
+	DefaultNamespace(446, "Education Program"),
+	DefaultNamespace(447, "Education Program talk"),
+	DefaultNamespace(710, "TimedText"),
+	DefaultNamespace(711, "TimedText talk"),
+	DefaultNamespace(828, "Module"),
+	DefaultNamespace(829, "Module talk"),
+	DefaultNamespace(2600, "Topic"),
+})
+
+// StandardNamespaces are the names of the namespaces of the English
+// Wikipedia.
+var StandardNamespaces Namespaces = StandardNamespaceTable.Namespaces()
@@ -74,10 +74,17 @@ const (
 )
 
 func ParseArticle(title, text string, g PageGetter) (*Article, error) {
+	return ParseArticleWithContext(title, text, g, nil)
+}
+
+// ParseArticleWithContext parses an article, using pc to expand the
+// variables that depend on the page revision, the wiki and the time.
+func ParseArticleWithContext(title, text string, g PageGetter, pc *PageContext) (*Article, error) {
 	a, err := NewArticle(title, text)
 	if err != nil {
 		return nil, err
 	}
+	a.Context = pc.withDefaults()
 	a.Tokens, err = a.Tokenize(a.MediaWiki, g)
 	if err != nil {
 		return a, err
@@ -229,11 +236,13 @@ func (a *Article) doQuotes() {
 			l = 0
 		}
 
-		if t[ni].TType != "quote" && t[ni].TType != "newline" {
+		// table cells are closed like lines
+		isNewline := t[ni].TType == "newline" || isTableToken(t[ni].TType)
+		if t[ni].TType != "quote" && !isNewline {
 			// log.Println(l)
 			tn = append(tn, t[ni])
 		}
-		if t[ni].TType == "newline" || ni == len(t)-1 {
+		if isNewline || ni == len(t)-1 {
 			// log.Println(l)
 			switch state {
 			case QS_b:
@@ -251,7 +260,7 @@ func (a *Article) doQuotes() {
 			l = 0
 			save = QS_none
 		}
-		if t[ni].TType == "newline" {
+		if isNewline {
 			// log.Println(l)
 			tn = append(tn, t[ni])
 		}
@@ -270,6 +279,8 @@ func (a *Article) parse() error {
 	}
 	root := &ParseNode{NType: "root", Nodes: nodes}
 	a.Root = root
+	a.resolveSortKeys()
+	a.resolveReferences()
 	a.Parsed = true
 	return nil
 }
@@ -324,7 +335,11 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 					}
 				}
 			}
-			if closebefore <= ni+1 {
+			if closebefore == len(t) && t[len(t)-1].TType == "newline" {
+				// the newline ending the last line is not part of the block
+				closebefore--
+			}
+			if closebefore <= ti+1 {
 				n := &ParseNode{NType: "html", NSubType: "pre"}
 				nl = append(nl, n)
 				ti++
@@ -359,6 +374,16 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 			nl = append(nl, n)
 			ti = ni + 1
 
+		case "magiclink":
+			id := t[ti].TPipes[0]
+			a.Identifiers = append(a.Identifiers, Identifier{Type: t[ti].TAttr, Id: id})
+			if u, ok := a.magicLinkURL(t[ti].TAttr, id); ok {
+				a.ExtLinks = append(a.ExtLinks, u)
+			}
+			n := &ParseNode{NType: "magiclink", NSubType: t[ti].TAttr, Contents: id,
+				Nodes: []*ParseNode{&ParseNode{NType: "text", Contents: html.UnescapeString(t[ti].TText)}}}
+			nl = append(nl, n)
+			ti++
 		case "closeextlink":
 			return nil, errors.New("Unmatched close external link token")
 		case "hrule":
@@ -419,7 +444,11 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 			}
 			var n *ParseNode
 			n = &ParseNode{NType: "link", Link: t[ti].TLink}
-			a.Links = append(a.Links, t[ti].TLink)
+			if t[ti].TLink.IsInterwiki() {
+				a.InterwikiLinks = append(a.InterwikiLinks, t[ti].TLink)
+			} else {
+				a.Links = append(a.Links, t[ti].TLink)
+			}
 			if ni > ti+1 {
 				nodes, err := a.internalParse(t[ti+1 : ni])
 				if err != nil {
@@ -448,21 +477,51 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 			}
 			var n *ParseNode
 			n = &ParseNode{NType: "image", Link: t[ti].TLink}
+			opts, _ := a.parseMediaOptions(t[ti].TPipes, t[ti].TAttr == "gallery")
 			a.Media = append(a.Media, t[ti].TLink)
+			a.MediaOptions = append(a.MediaOptions, opts)
+			if a.nodeMedia == nil {
+				a.nodeMedia = make(map[*ParseNode]*MediaOptions)
+			}
+			a.nodeMedia[n] = opts
 			if ni > ti+1 {
 				nodes, err := a.internalParse(t[ti+1 : ni])
 				if err != nil {
 					return nil, err
 				}
 				n.Nodes = nodes
+				if len(t[ti].TPipes) > 0 {
+					opts.Caption = nodes
+				}
 			}
 			nl = append(nl, n)
 			ti = ni + 1
 
+		case "gallery":
+			ni := ti + 1
+			for ; ni < len(t) && t[ni].TType != "closegallery"; ni++ {
+			}
+			if ni == len(t) {
+				return nil, errors.New("Unmatched gallery token")
+			}
+			nodes, err := a.internalParse(t[ti+1 : ni])
+			if err != nil {
+				return nil, err
+			}
+			nl = append(nl, &ParseNode{NType: "gallery", Contents: t[ti].TAttr, Nodes: nodes})
+			ti = ni + 1
+		case "languagelink":
+			a.LanguageLinks = append(a.LanguageLinks, t[ti].TLink)
+			ti++
+		case "category":
+			a.Categories = append(a.Categories, Category{Link: t[ti].TLink, Name: t[ti].TLink.PageName, SortKey: t[ti].TAttr})
+			ti++
 		case "closelink":
 			return nil, errors.New("Unmatched close link token")
 		case "closefilelink":
 			return nil, errors.New("Unmatched close file link token")
+		case "closegallery":
+			return nil, errors.New("Unmatched close gallery token")
 		case "html":
 			tag := strings.ToLower(t[ti].TText)
 			if tag[0] == '/' {
@@ -470,7 +529,13 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 				continue
 			}
 			n := &ParseNode{NType: "html", NSubType: tag, Contents: t[ti].TAttr}
+			if tag == "ref" || tag == "references" {
+				// footnotes are numbered by resolveReferences
+				n = &ParseNode{NType: tag, Contents: t[ti].TAttr}
+			}
 			if t[ti].TClosed == true {
+				// the attributes of a self-closing tag end with its /
+				n.Contents = strings.TrimSuffix(strings.TrimRight(n.Contents, " \t\r\n"), "/")
 				flags := TClosed
 				n.Flags = flags
 				nl = append(nl, n)
@@ -511,85 +576,38 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 				ti = len(t)
 			}
 		case "*", "#", ";", ":":
-			ti += 1
-			/*			stack := ""
-						si := 0
-						ni := ti
-						ln := &ParseNode{NType: "root", Nodes: make([]*ParseNode, 0, 4)}
-						for {
-
-							this := ""
-							islist := false
-							for ; ni < len(t); ni++ {
-								switch t[ni].TType {
-								case "*", "#", ";", ":":
-									islist = true
-								}
-								if islist {
-									this += t[ni].TType
-								} else {
-									break
-								}
-							}
-							same := 0
-							for i := 0; i < len(this) && i < len(stack); i++ {
-								if this[i] == stack[i] ||
-									(this[i] == ';' && stack[i] == ':') ||
-									(this[i] == ':' && stack[i] == ';') {
-									same++
-								} else {
-									break
-								}
-							}
-							n := ln
-							for i := 0; i < same; i++ {
-								n = n.Nodes[len(n.Nodes)-1]
-								n = n.Nodes[len(n.Nodes)-1]
-							}
-
-							for i := same; i < len(this); i++ { //open
-								var nn *ParseNode
-								switch this[i] {
-								case '*':
-									nn = &ParseNode{NType: "html", NSubType: "ul"}
-								case '#':
-									nn = &ParseNode{NType: "html", NSubType: "ol"}
-								case ';':
-									nn = &ParseNode{NType: "html", NSubType: "dl"}
-								case ':':
-									nn = &ParseNode{NType: "html", NSubType: "dl"}
-								}
-								nn.Nodes = make([]*ParseNode, 0, 1)
-								n.Nodes = append(n.Nodes, nn)
-								n = nn
-								if i < len(this)-1 {
-									var elem *ParseNode
-									switch this[len] {
-									case '*', '#':
-										elem = &ParseNode{NType: "html", NSubType: "li"}
-									case ';':
-										elem = &ParseNode{NType: "html", NSubType: "dt"}
-									case ':':
-										elem = &ParseNode{NType: "html", NSubType: "dd"}
-									}
-									elem.Nodes = make([]*ParseNode, 0, 1)
-									n.Nodes = append(n.Nodes, elem)
-									n = elem
-								}
-							}
-							var nitem *ParseNode
-							switch this[len] {
-							case '*', '#':
-								nitem = &ParseNode{NType: "html", NSubType: "li"}
-							case ';':
-								nitem = &ParseNode{NType: "html", NSubType: "dt"}
-							case ':':
-								nitem = &ParseNode{NType: "html", NSubType: "dd"}
-							}
-							n := &ParseNode{NType: "html", NSubType: st}
-							nl = append(nl, n)
-
-						} */
+			nodes, ni, err := a.parseList(t[ti:])
+			if err != nil {
+				return nil, err
+			}
+			nl = append(nl, nodes...)
+			ti += ni
+		case "tablestart":
+			ni := ti + 1
+			nopen := 1
+			for ; ni < len(t); ni++ {
+				switch t[ni].TType {
+				case "tablestart":
+					nopen++
+				case "tableend":
+					nopen--
+				}
+				if nopen == 0 {
+					break
+				}
+			}
+			nodes, err := a.parseTable(t[ti:ni])
+			if err != nil {
+				return nil, err
+			}
+			nl = append(nl, nodes...)
+			ti = ni + 1
+			if ti > len(t) {
+				ti = len(t)
+			}
+		case "tableend", "tablerow", "tablecaption", "tableheader", "tablecell":
+			// stray table markup, e.g. a table split by an html element
+			ti++
 		case "newline":
 			n := &ParseNode{NType: "text", Contents: "\n"}
 			nl = append(nl, n)
@@ -625,6 +643,15 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 			} else {
 				n := &ParseNode{NType: t[ti].TType, Contents: a.Templates[templateIndex].Name}
 				nl = append(nl, n)
+				if t[ti].TType == "tb" {
+					if a.nodeTemplates == nil {
+						a.nodeTemplates = make(map[*ParseNode]*Template)
+					}
+					a.nodeTemplates[n] = a.Templates[templateIndex]
+					if rn := a.reflistNode(a.Templates[templateIndex]); rn != nil {
+						nl = append(nl, rn)
+					}
+				}
 			}
 			ti++
 
@@ -634,3 +661,214 @@ func (a *Article) internalParse(t []*Token) ([]*ParseNode, error) {
 	}
 	return nl, nil
 }
+
+// parseTable builds the table node for the tokens of a table, t[0] being the
+// tablestart token and the matching tableend excluded. Content found outside
+// of any cell is returned before the table, as browsers do.
+func (a *Article) parseTable(t []*Token) ([]*ParseNode, error) {
+	table := &ParseNode{NType: "html", NSubType: "table", Contents: t[0].TAttr}
+	out := make([]*ParseNode, 0, 1)
+	var row *ParseNode
+	var cur *ParseNode
+	pending := 1
+	flush := func(end int) error {
+		tokens := trimBlankTokens(t[pending:end])
+		if len(tokens) == 0 {
+			return nil
+		}
+		nodes, err := a.internalParse(tokens)
+		if err != nil {
+			return err
+		}
+		if cur != nil {
+			cur.Nodes = append(cur.Nodes, nodes...)
+		} else {
+			out = append(out, nodes...)
+		}
+		return nil
+	}
+	depth := 0
+	for i := 1; i < len(t); i++ {
+		switch t[i].TType {
+		case "tablestart":
+			depth++
+			continue
+		case "tableend":
+			depth--
+			continue
+		case "tablecaption", "tablerow", "tableheader", "tablecell":
+			if depth > 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := flush(i); err != nil {
+			return nil, err
+		}
+		pending = i + 1
+		switch t[i].TType {
+		case "tablecaption":
+			cur = &ParseNode{NType: "html", NSubType: "caption", Contents: t[i].TAttr}
+			table.Nodes = append(table.Nodes, cur)
+		case "tablerow":
+			row = &ParseNode{NType: "html", NSubType: "tr", Contents: t[i].TAttr}
+			table.Nodes = append(table.Nodes, row)
+			cur = nil
+		case "tableheader", "tablecell":
+			if row == nil {
+				row = &ParseNode{NType: "html", NSubType: "tr"}
+				table.Nodes = append(table.Nodes, row)
+			}
+			cur = &ParseNode{NType: "html", NSubType: "td", Contents: t[i].TAttr}
+			if t[i].TType == "tableheader" {
+				cur.NSubType = "th"
+			}
+			row.Nodes = append(row.Nodes, cur)
+		}
+	}
+	if err := flush(len(t)); err != nil {
+		return nil, err
+	}
+	// empty rows are dropped
+	nodes := table.Nodes[:0]
+	for _, n := range table.Nodes {
+		if n.NSubType != "tr" || len(n.Nodes) > 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	table.Nodes = nodes
+	return append(out, table), nil
+}
+
+func trimBlankTokens(t []*Token) []*Token {
+	isBlank := func(tt string) bool {
+		return tt == "newline" || tt == "space" || tt == "blank"
+	}
+	for len(t) > 0 && isBlank(t[0].TType) {
+		t = t[1:]
+	}
+	for len(t) > 0 && isBlank(t[len(t)-1].TType) {
+		t = t[:len(t)-1]
+	}
+	return t
+}
+
+func isListToken(tt string) bool {
+	return tt == "*" || tt == "#" || tt == ";" || tt == ":"
+}
+
+type listLevel struct {
+	list *ParseNode
+	item *ParseNode
+}
+
+func newListNode(c byte) *ParseNode {
+	switch c {
+	case '*':
+		return &ParseNode{NType: "html", NSubType: "ul"}
+	case '#':
+		return &ParseNode{NType: "html", NSubType: "ol"}
+	}
+	return &ParseNode{NType: "html", NSubType: "dl"}
+}
+
+func newListItem(c byte) *ParseNode {
+	switch c {
+	case ';':
+		return &ParseNode{NType: "html", NSubType: "dt"}
+	case ':':
+		return &ParseNode{NType: "html", NSubType: "dd"}
+	}
+	return &ParseNode{NType: "html", NSubType: "li"}
+}
+
+// parseList builds the nested lists for the run of consecutive list lines
+// at the beginning of t, following MediaWiki's doBlockLevels. It returns the
+// nodes and the number of tokens consumed.
+func (a *Article) parseList(t []*Token) ([]*ParseNode, int, error) {
+	out := make([]*ParseNode, 0, 1)
+	stack := make([]listLevel, 0, 4)
+	last := ""
+	pos := 0
+	for pos < len(t) && isListToken(t[pos].TType) {
+		prefix := ""
+		for ; pos < len(t) && isListToken(t[pos].TType); pos++ {
+			prefix += t[pos].TType
+		}
+		cs := pos
+		for pos < len(t) && t[pos].TType != "newline" {
+			pos++
+		}
+		content := t[cs:pos]
+		if pos < len(t) {
+			pos++
+		}
+
+		// ';' and ':' continue the same definition list
+		p2 := strings.Replace(prefix, ";", ":", -1)
+		common := 0
+		for common < len(p2) && common < len(last) && p2[common] == last[common] {
+			common++
+		}
+		stack = stack[:common]
+		if len(prefix) <= common && common > 0 {
+			lv := &stack[common-1]
+			lv.item = newListItem(prefix[common-1])
+			lv.list.Nodes = append(lv.list.Nodes, lv.item)
+		}
+		for len(stack) < len(prefix) {
+			c := prefix[len(stack)]
+			lv := listLevel{list: newListNode(c), item: newListItem(c)}
+			lv.list.Nodes = append(lv.list.Nodes, lv.item)
+			if len(stack) == 0 {
+				out = append(out, lv.list)
+			} else {
+				parent := stack[len(stack)-1].item
+				parent.Nodes = append(parent.Nodes, lv.list)
+			}
+			stack = append(stack, lv)
+		}
+		last = p2
+
+		lv := &stack[len(stack)-1]
+		if prefix[len(prefix)-1] == ';' {
+			// "; term : definition" on a single line
+			if ci := findListColon(content); ci >= 0 {
+				nodes, err := a.internalParse(trimBlankTokens(content[:ci]))
+				if err != nil {
+					return nil, 0, err
+				}
+				lv.item.Nodes = append(lv.item.Nodes, nodes...)
+				lv.item = newListItem(':')
+				lv.list.Nodes = append(lv.list.Nodes, lv.item)
+				content = content[ci+1:]
+			}
+		}
+		nodes, err := a.internalParse(trimBlankTokens(content))
+		if err != nil {
+			return nil, 0, err
+		}
+		lv.item.Nodes = append(lv.item.Nodes, nodes...)
+	}
+	return out, pos, nil
+}
+
+// findListColon returns the index of the first colon of t that is not part
+// of a link, or -1.
+func findListColon(t []*Token) int {
+	depth := 0
+	for i := range t {
+		switch t[i].TType {
+		case "link", "extlink", "filelink":
+			depth++
+		case "closelink", "closeextlink", "closefilelink":
+			depth--
+		case "colon":
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
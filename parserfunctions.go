@@ -0,0 +1,239 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lazyText returns the trimmed expansion of a piece of wikitext, computing
+// it only when called.
+type lazyText func() string
+
+// pfArg is a parser function argument. Arguments are expanded only when a
+// parser function needs them, so that only the taken branch of a
+// conditional is rendered.
+type pfArg struct {
+	text  lazyText // the whole argument
+	name  lazyText // the text before the first '=', nil if there is none
+	value lazyText // the text after the first '='
+}
+
+func staticText(s string) lazyText {
+	s = strings.TrimSpace(s)
+	return func() string { return s }
+}
+
+// parserFunction renders a parser function given the text after the colon
+// and the remaining arguments.
+type parserFunction func(a *Article, g PageGetter, arg0 string, args []*pfArg) string
+
+var parserFunctions map[string]parserFunction
+
+func init() {
+	parserFunctions = map[string]parserFunction{
+		"#if":      pfIf,
+		"#ifeq":    pfIfEq,
+		"#iferror": pfIfError,
+		"#ifexpr":  pfIfExpr,
+		"#ifexist": pfIfExist,
+		"#switch":  pfSwitch,
+		"#expr":    pfExpr,
+		"#time":    pfTime,
+		"#timel":   pfTimel,
+	}
+}
+
+func argText(args []*pfArg, i int) string {
+	if i < len(args) {
+		return args[i].text()
+	}
+	return ""
+}
+
+// splitParserFunctionName splits "#name: arg0" into the lowercase function
+// name and its first argument.
+func splitParserFunctionName(tn string) (string, string) {
+	i := strings.Index(tn, ":")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(tn)), ""
+	}
+	return strings.ToLower(strings.TrimSpace(tn[:i])), strings.TrimSpace(tn[i+1:])
+}
+
+func (a *Article) renderTemplateExt(name string, args []*pfArg, g PageGetter) string {
+	fn, arg0 := splitParserFunctionName(name)
+	f, ok := parserFunctions[fn]
+	if !ok {
+		return ""
+	}
+	return f(a, g, arg0, args)
+}
+
+// paramsToArgs converts already expanded template parameters into parser
+// function arguments, positional ones first.
+func paramsToArgs(params map[string]string) []*pfArg {
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ni, erri := strconv.Atoi(names[i])
+		nj, errj := strconv.Atoi(names[j])
+		switch {
+		case erri == nil && errj == nil:
+			return ni < nj
+		case erri == nil || errj == nil:
+			return erri == nil
+		}
+		return names[i] < names[j]
+	})
+	args := make([]*pfArg, 0, len(names))
+	for _, k := range names {
+		if _, err := strconv.Atoi(k); err == nil {
+			args = append(args, &pfArg{text: staticText(params[k]), value: staticText(params[k])})
+			continue
+		}
+		args = append(args, &pfArg{text: staticText(k + "=" + params[k]), name: staticText(k), value: staticText(params[k])})
+	}
+	return args
+}
+
+func pfIf(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if len(arg0) > 0 {
+		return argText(args, 0)
+	}
+	return argText(args, 1)
+}
+
+// phpNumeric reports whether s would be considered numeric by PHP.
+func phpNumeric(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || strings.ContainsAny(s, "xXpP_") {
+		return 0, false
+	}
+	switch strings.ToLower(strings.TrimLeft(s, "+-")) {
+	case "inf", "infinity", "nan":
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// pfEqual compares two strings numerically if both are numbers, as
+// #ifeq and #switch do.
+func pfEqual(l, r string) bool {
+	lv, lok := phpNumeric(l)
+	rv, rok := phpNumeric(r)
+	if lok && rok {
+		return lv == rv
+	}
+	return l == r
+}
+
+func pfIfEq(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if pfEqual(arg0, argText(args, 0)) {
+		return argText(args, 1)
+	}
+	return argText(args, 2)
+}
+
+var errorClassRe = regexp.MustCompile(`<(?:strong|span|p|div)\s(?:[^\s>]*\s+)*?class="(?:[^"\s>]*\s+)*?error(?:\s[^">]*)?"`)
+
+func pfIfError(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	if errorClassRe.MatchString(arg0) {
+		return argText(args, 0)
+	}
+	if len(args) > 1 {
+		return args[1].text()
+	}
+	return arg0
+}
+
+func exprErrorText(err error) string {
+	return `<strong class="error">` + err.Error() + `</strong>`
+}
+
+func pfExpr(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	v, err := EvalExpr(arg0)
+	if err != nil {
+		return exprErrorText(err)
+	}
+	return v
+}
+
+func pfIfExpr(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	v, err := EvalExpr(arg0)
+	if err != nil {
+		return exprErrorText(err)
+	}
+	if f, ok := phpNumeric(v); len(v) > 0 && (!ok || f != 0) {
+		return argText(args, 0)
+	}
+	return argText(args, 1)
+}
+
+func pfIfExist(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	exists := false
+	if len(arg0) > 0 && g != nil {
+		mw, err := g.Get(a.namespaces().WikiCanonicalFormNamespaceEsc(arg0, "", true))
+		exists = err == nil && len(mw) > 0
+	}
+	if exists {
+		return argText(args, 0)
+	}
+	return argText(args, 1)
+}
+
+func pfSwitch(a *Article, g PageGetter, arg0 string, args []*pfArg) string {
+	found := false
+	lastHadNoEquals := false
+	var def *pfArg
+	test := ""
+	for _, arg := range args {
+		if arg.name == nil {
+			// multiple inputs, single output: remember a match and go on
+			lastHadNoEquals = true
+			test = arg.value()
+			if pfEqual(test, arg0) {
+				found = true
+			}
+			continue
+		}
+		lastHadNoEquals = false
+		if found {
+			return arg.value()
+		}
+		test = arg.name()
+		switch {
+		case pfEqual(test, arg0):
+			return arg.value()
+		case test == "#default":
+			def = arg
+		}
+	}
+	switch {
+	case lastHadNoEquals:
+		return test
+	case def != nil:
+		return def.value()
+	}
+	return ""
+}
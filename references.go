@@ -0,0 +1,254 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reference is a footnote of the article, defined by a <ref> tag and
+// possibly reused by name.
+type Reference struct {
+	Name      string       // name attribute, empty for anonymous footnotes
+	Group     string       // group attribute, empty for the default group
+	Number    int          // number of the footnote in its group, from 1
+	Node      *ParseNode   // ref node holding the content, nil if never defined
+	Text      string       // plain text of the content
+	Links     []WikiLink   // internal links of the content
+	ExtLinks  []string     // external links of the content
+	Templates []*Template  // templates of the content, e.g. {{cite web}}
+	Uses      []*ParseNode // ref nodes citing the footnote, in order
+	List      *ParseNode   // references node listing it, nil for the list at the end of the page
+
+	index int // position in Article.References, from 1
+}
+
+// Label returns the text of the marks of the footnote, e.g. "1" or "note 2".
+func (ref *Reference) Label() string {
+	if len(ref.Group) == 0 {
+		return strconv.Itoa(ref.Number)
+	}
+	return ref.Group + " " + strconv.Itoa(ref.Number)
+}
+
+// noteId returns the id of the footnote in the references list.
+func (ref *Reference) noteId() string {
+	if len(ref.Name) == 0 {
+		return "cite_note-" + strconv.Itoa(ref.index)
+	}
+	return "cite_note-" + anchorEncode(ref.Name) + "-" + strconv.Itoa(ref.index)
+}
+
+// useId returns the id of the use-th mark of the footnote in the text.
+func (ref *Reference) useId(use int) string {
+	if len(ref.Name) == 0 {
+		return "cite_ref-" + strconv.Itoa(ref.index)
+	}
+	return "cite_ref-" + anchorEncode(ref.Name) + "_" + strconv.Itoa(ref.index) + "-" + strconv.Itoa(use)
+}
+
+type refUse struct {
+	ref *Reference
+	use int
+}
+
+type refKey struct {
+	group string
+	name  string
+}
+
+// reflistTemplates are the templates placing a references list, with the
+// group they list.
+var reflistTemplates = map[string]string{
+	"Reflist":    "",
+	"References": "",
+	"Notelist":   "lower-alpha",
+}
+
+// reflistNode returns the references node placed by a {{reflist}} template,
+// or nil if t is not such a template.
+func (a *Article) reflistNode(t *Template) *ParseNode {
+	if t.Typ != "normal" {
+		return nil
+	}
+	wl := a.namespaces().WikiCanonicalFormNamespaceEsc(t.Name, "Template", true)
+	group, ok := reflistTemplates[wl.PageName]
+	if !ok || wl.NamespaceId != 10 {
+		return nil
+	}
+	if g, ok := t.Parameters["group"]; ok {
+		group = strings.TrimSpace(g)
+	}
+	attr := ""
+	if len(group) > 0 {
+		attr = ` group="` + strings.Replace(group, `"`, "&quot;", -1) + `"`
+	}
+	return &ParseNode{NType: "references", NSubType: "template", Contents: attr}
+}
+
+// hasReferences tells if the subtrees of nodes contain a references node.
+func hasReferences(nodes []*ParseNode) bool {
+	for _, n := range nodes {
+		if n.NType == "references" || hasReferences(n.Nodes) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandsReferences tells if the expansion of the template started just
+// before nodes contains a references list, which then takes the place of the
+// one added for the template.
+func expandsReferences(nodes []*ParseNode, name string) bool {
+	for _, n := range nodes {
+		if n.NType == "te" && n.Contents == name {
+			return false
+		}
+		if n.NType == "references" || hasReferences(n.Nodes) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveReferences numbers the footnotes of the parse tree as MediaWiki
+// does: per group, in order of first use, restarting after each references
+// list. Named footnotes are merged and the footnotes defined inside a
+// references list get their content from there.
+func (a *Article) resolveReferences() {
+	a.References = make([]*Reference, 0, 4)
+	a.refUses = make(map[*ParseNode]refUse)
+	named := make(map[refKey]*Reference)
+	count := make(map[string]int)
+	pending := make([]*Reference, 0, 4)
+
+	var walk func(nodes []*ParseNode, list *ParseNode, listGroup string)
+	walk = func(nodes []*ParseNode, list *ParseNode, listGroup string) {
+		for i, n := range nodes {
+			switch n.NType {
+			case "ref":
+				attrs := parseAttributes(n.Contents)
+				group, ok := attrs["group"]
+				if !ok && list != nil {
+					group = listGroup
+				}
+				key := refKey{group, attrs["name"]}
+				ref := named[key]
+				if list != nil {
+					// list defined footnotes must be named and used in the text
+					if ref != nil && ref.Node == nil && len(n.Nodes) > 0 {
+						ref.Node = n
+					}
+					continue
+				}
+				if ref == nil {
+					ref = &Reference{Name: key.name, Group: group}
+					a.References = append(a.References, ref)
+					ref.index = len(a.References)
+					if len(key.name) > 0 {
+						named[key] = ref
+					}
+					count[group]++
+					ref.Number = count[group]
+					pending = append(pending, ref)
+				}
+				if ref.Node == nil && len(n.Nodes) > 0 {
+					ref.Node = n
+				}
+				a.refUses[n] = refUse{ref, len(ref.Uses)}
+				ref.Uses = append(ref.Uses, n)
+			case "references":
+				if n.NSubType == "template" && i > 0 && expandsReferences(nodes[i+1:], nodes[i-1].Contents) {
+					continue
+				}
+				group := parseAttributes(n.Contents)["group"]
+				walk(n.Nodes, n, group)
+				rest := pending[:0]
+				for _, ref := range pending {
+					if ref.Group != group {
+						rest = append(rest, ref)
+						continue
+					}
+					ref.List = n
+					delete(named, refKey{group, ref.Name})
+				}
+				pending = rest
+				count[group] = 0
+			default:
+				walk(n.Nodes, list, listGroup)
+			}
+		}
+	}
+	if a.Root != nil {
+		walk(a.Root.Nodes, nil, "")
+	}
+
+	for _, ref := range a.References {
+		if ref.Node == nil {
+			continue
+		}
+		text, _ := a.genNodesText(ref.Node.Nodes)
+		ref.Text = strings.TrimSpace(text)
+		ref.Links = collectLinks(ref.Node.Nodes)
+		ref.ExtLinks = collectExtLinks(ref.Node.Nodes)
+		ref.Templates = a.collectTemplates(ref.Node.Nodes)
+	}
+}
+
+// collectExtLinks returns the external links found in the subtrees of nodes.
+func collectExtLinks(nodes []*ParseNode) []string {
+	out := make([]string, 0, 1)
+	for _, n := range nodes {
+		if n.NType == "extlink" {
+			out = append(out, n.Contents)
+		}
+		out = append(out, collectExtLinks(n.Nodes)...)
+	}
+	return out
+}
+
+// collectTemplates returns the templates whose expansion starts in the
+// subtrees of nodes.
+func (a *Article) collectTemplates(nodes []*ParseNode) []*Template {
+	out := make([]*Template, 0, 1)
+	for _, n := range nodes {
+		if t, ok := a.nodeTemplates[n]; ok {
+			out = append(out, t)
+		}
+		out = append(out, a.collectTemplates(n.Nodes)...)
+	}
+	return out
+}
+
+// listedReferences returns the footnotes listed by the references node n,
+// or those listed at the end of the page if n is nil.
+func (a *Article) listedReferences(n *ParseNode) []*Reference {
+	out := make([]*Reference, 0, 4)
+	for _, ref := range a.References {
+		if ref.List == n {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// GetReferences returns the footnotes of the article, in order of first
+// use.
+func (a *Article) GetReferences() []*Reference {
+	return a.References
+}
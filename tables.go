@@ -0,0 +1,158 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	maxColSpan = 1000
+	maxRowSpan = 65534
+)
+
+// Table is a wikitable with its cells laid out in a rectangular grid.
+type Table struct {
+	Attr         string
+	Caption      string
+	CaptionNodes []*ParseNode
+	// HeaderRows is the number of leading rows made only of header cells
+	HeaderRows int
+	// Rows holds the cells with rowspan and colspan expanded: a spanning
+	// cell appears in every position it covers. Positions not covered by
+	// any cell are nil.
+	Rows [][]*TableCell
+	Node *ParseNode
+}
+
+type TableCell struct {
+	Header  bool
+	Attr    string
+	RowSpan int
+	ColSpan int
+	Row     int // grid position of the top left corner of the cell
+	Col     int
+	Node    *ParseNode
+	Text    string
+	Links   []WikiLink
+}
+
+// GetTables returns the tables of the article, nested tables included, in
+// document order.
+func (a *Article) GetTables() []*Table {
+	out := make([]*Table, 0, 4)
+	if a.Root == nil {
+		return out
+	}
+	return a.findTables(a.Root, out)
+}
+
+func (a *Article) findTables(root *ParseNode, out []*Table) []*Table {
+	for _, n := range root.Nodes {
+		if n.NType == "html" && n.NSubType == "table" {
+			out = append(out, a.newTable(n))
+		}
+		out = a.findTables(n, out)
+	}
+	return out
+}
+
+func (a *Article) newTable(n *ParseNode) *Table {
+	t := &Table{Attr: n.Contents, Node: n}
+	trs := make([]*ParseNode, 0, len(n.Nodes))
+	for _, c := range n.Nodes {
+		switch c.NSubType {
+		case "caption":
+			if t.CaptionNodes == nil {
+				t.CaptionNodes = c.Nodes
+				text, _ := a.genNodesText(c.Nodes)
+				t.Caption = strings.TrimSpace(text)
+			}
+		case "tr":
+			trs = append(trs, c)
+		}
+	}
+	grid := make([][]*TableCell, len(trs))
+	width := 0
+	for r, tr := range trs {
+		col := 0
+		for _, cn := range tr.Nodes {
+			for col < len(grid[r]) && grid[r][col] != nil {
+				col++
+			}
+			cell := a.newTableCell(cn)
+			cell.Row, cell.Col = r, col
+			for dr := 0; dr < cell.RowSpan && r+dr < len(grid); dr++ {
+				row := grid[r+dr]
+				for len(row) < col+cell.ColSpan {
+					row = append(row, nil)
+				}
+				for dc := 0; dc < cell.ColSpan; dc++ {
+					if row[col+dc] == nil {
+						row[col+dc] = cell
+					}
+				}
+				grid[r+dr] = row
+			}
+			col += cell.ColSpan
+		}
+		if len(grid[r]) > width {
+			width = len(grid[r])
+		}
+	}
+	for r := range grid {
+		for len(grid[r]) < width {
+			grid[r] = append(grid[r], nil)
+		}
+	}
+	t.Rows = grid
+	for _, row := range grid {
+		for _, c := range row {
+			if c != nil && !c.Header {
+				return t
+			}
+		}
+		t.HeaderRows++
+	}
+	return t
+}
+
+func (a *Article) newTableCell(n *ParseNode) *TableCell {
+	attrs := parseAttributes(n.Contents)
+	text, _ := a.genNodesText(n.Nodes)
+	return &TableCell{
+		Header:  n.NSubType == "th",
+		Attr:    n.Contents,
+		RowSpan: spanValue(attrs["rowspan"], maxRowSpan),
+		ColSpan: spanValue(attrs["colspan"], maxColSpan),
+		Node:    n,
+		Text:    strings.TrimSpace(text),
+		Links:   collectLinks(n.Nodes),
+	}
+}
+
+func spanValue(s string, max int) int {
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	switch {
+	case err != nil, v < 1:
+		return 1
+	case v > max:
+		return max
+	}
+	return v
+}
@@ -29,6 +29,25 @@ type Template struct {
 	Name       string            `json:"name"`
 	Attr       string            `json:"attr"` //text after the ':' in magic templates
 	Parameters map[string]string `json:"parameters"`
+	// the parameters in order, including the duplicate ones
+	Params []TemplateParam `json:"params"`
+
+	inner [][]*Template // templates called in each of Params
+}
+
+// TemplateParam is a parameter of a template call as written in the page.
+// Start and End are the byte offsets of Raw in the wikitext of the article,
+// so that Raw can be replaced without touching the rest of the call.
+type TemplateParam struct {
+	Name       string `json:"name"`
+	Positional bool   `json:"positional"`
+	Raw        string `json:"raw"`   // text between the pipes, untrimmed, e.g. " name = value\n"
+	Value      string `json:"value"` // trimmed value, with the inner templates expanded
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Duplicate  bool   `json:"duplicate"` // overridden by a later parameter with the same name
+
+	source string // trimmed value without the comments and the inner templates expanded
 }
 
 func (a *Article) parseTemplateEtc(l string) []Template {
@@ -49,6 +68,10 @@ type template struct {
 	children []*template
 	rt       string
 	rendered bool
+	values   []string // expanded values of the parameters, in order
+	// the call as expanded, set by renderInnerTemplates
+	name   string
+	params map[string]string
 }
 
 type byStart []*template
@@ -225,7 +248,7 @@ func findTemplateParamPos(mw string, t *template) [][]int { //first is position
 	return string(out), tokens
 } */
 
-func (a *Article) processTemplates(mws string, tokens map[string]*Token, g PageGetter) (string, map[string]*Token) {
+func (a *Article) processTemplates(mws string, tokens map[string]*Token, g PageGetter, src *sourceText) (string, map[string]*Token) {
 	//strip nowiki noinclude etc here
 	//	mws := a.stripComments(mw)
 	//	mws = a.stripNoinclude(mws)
@@ -241,6 +264,8 @@ func (a *Article) processTemplates(mws string, tokens map[string]*Token, g PageG
 		se := fmt.Sprintf("\x07te%05d", i)
 		tn, pm := a.renderInnerTemplates(mws, t, nil, g, 0)
 		a.addTemplate(tn, pm)
+		at := a.Templates[len(a.Templates)-1]
+		at.Params, at.inner = templateParams(mws, t, pm, tokens, src)
 		out = append(out, []byte(mws[last:t.b])...)
 		out = append(out, []byte(sb+t.rt+se)...)
 		last = t.e
@@ -260,6 +285,82 @@ func (a *Article) processTemplates(mws string, tokens map[string]*Token, g PageG
 	return string(out), tokens
 }
 
+var specialRe = regexp.MustCompile("\x07[0-9]{7}")
+
+// unstripSpecials restores the source of the nowiki, pre, math and gallery
+// blocks replaced by special markers in s.
+func unstripSpecials(s string, specials map[string]*Token) string {
+	if strings.IndexByte(s, '\x07') < 0 {
+		return s
+	}
+	return specialRe.ReplaceAllStringFunc(s, func(m string) string {
+		t, ok := specials[m]
+		if !ok {
+			return m
+		}
+		return "<" + t.TType + t.TAttr + ">" + t.TText + "</" + t.TType + ">"
+	})
+}
+
+// templateParams returns the parameters of the template t of mws in order,
+// with the templates called in each of them. src maps the offsets in mws to
+// the wikitext of the article.
+func templateParams(mws string, t *template, pm map[string]string, specials map[string]*Token, src *sourceText) ([]TemplateParam, [][]*Template) {
+	if t.isparam {
+		return nil, nil
+	}
+	pp := findTemplateParamPos(mws, t)
+	pp = append(pp, []int{t.e - 2})
+	out := make([]TemplateParam, 0, len(pp)-1)
+	inner := make([][]*Template, 0, len(pp)-1)
+	last := make(map[string]int, len(pp))
+	positional := 0
+	for i := 0; i < len(pp)-1; i++ {
+		var name, source string
+		p := TemplateParam{Positional: len(pp[i]) == 1}
+		if !p.Positional {
+			name = strings.TrimSpace(mws[pp[i][0]+1 : pp[i][1]])
+			source = strings.TrimSpace(mws[pp[i][1]+1 : pp[i+1][0]])
+		} else {
+			positional++
+			name = fmt.Sprint(positional)
+			source = strings.TrimSpace(mws[pp[i][0]+1 : pp[i+1][0]])
+		}
+		p.Name = unstripSpecials(name, specials)
+		p.source = unstripSpecials(source, specials)
+		if i < len(t.values) {
+			p.Value = unstripSpecials(t.values[i], specials)
+		} else {
+			p.Value = unstripSpecials(pm[name], specials)
+		}
+		inner = append(inner, innerTemplates(mws, t, pp[i][0], pp[i+1][0], specials, src))
+		p.Start, p.End = src.offset(pp[i][0])+1, src.offset(pp[i+1][0])
+		p.Raw = src.text[p.Start:p.End]
+		if j, ok := last[p.Name]; ok {
+			out[j].Duplicate = true
+		}
+		last[p.Name] = len(out)
+		out = append(out, p)
+	}
+	return out, inner
+}
+
+// innerTemplates returns the templates called by the children of t found
+// between the offsets b and e of mws, as they were expanded.
+func innerTemplates(mws string, t *template, b, e int, specials map[string]*Token, src *sourceText) []*Template {
+	var out []*Template
+	for _, ct := range t.children {
+		if ct.b < b || ct.e > e || !ct.rendered || ct.isparam {
+			continue
+		}
+		it := &Template{Parameters: ct.params}
+		it.Name, it.Attr, it.Typ, _ = detectTemplateType(ct.name)
+		it.Params, it.inner = templateParams(mws, ct, ct.params, specials, src)
+		out = append(out, it)
+	}
+	return out
+}
+
 func (a *Article) addTemplate(tn string, pm map[string]string) {
 	outT := Template{Parameters: pm}
 	base, attr, typ, _ := detectTemplateType(tn)
@@ -284,6 +385,7 @@ func (a *Article) renderTemplate(mw string, t *template) string {
 	}
 	pm := make(map[string]string, len(pp))
 	pp = append(pp, []int{t.e - n})
+	positional := 0 // positional parameters are numbered apart from the named ones
 	for i := 0; i < len(pp)-1; i++ {
 		var name string
 		var param string
@@ -291,7 +393,8 @@ func (a *Article) renderTemplate(mw string, t *template) string {
 			name = fmt.Sprint(strings.TrimSpace(mw[pp[i][0]+1 : pp[i][1]]))
 			param = fmt.Sprint(strings.TrimSpace(mw[pp[i][1]+1 : pp[i+1][0]]))
 		} else {
-			name = fmt.Sprint(i + 1)
+			positional++
+			name = fmt.Sprint(positional)
 			param = fmt.Sprint(strings.TrimSpace(mw[pp[i][0]+1 : pp[i+1][0]]))
 		}
 		pm[name] = param
@@ -327,6 +430,9 @@ func detectTemplateType(tn string) (string, string, string, string) {
 	if ok {
 		return base, attr, "magic", ""
 	}
+	if strings.HasPrefix(base, "#") {
+		return base, attr, "ext", ""
+	}
 
 	return tn, "", "normal", ""
 }
@@ -347,7 +453,7 @@ var noHashFunctionsMap map[string]bool = map[string]bool{
 	"special":          true,
 	"tag":              true,
 	"anchorencode":     true, "basepagenamee": true, "basepagename": true, "canonicalurle": true,
-	"canonicalurl": true, "cascadingsources": true, "defaultsort": true, "filepath": true,
+	"canonicalurl": true, "cascadingsources": true, "defaultsort": true, "defaultsortkey": true, "defaultcategorysort": true, "filepath": true,
 	"formatnum": true, "fullpagenamee": true, "fullpagename": true, "fullurle": true,
 	"fullurl": true, "gender": true, "grammar": true, "language": true,
 	"lcfirst": true, "lc": true, "localurle": true, "localurl": true,
@@ -444,14 +550,6 @@ var variablesMap map[string]bool = map[string]bool{
 	"talkspace":           true,
 }
 
-func (a *Article) renderTemplateMagic(name string, params map[string]string) string {
-	return ""
-}
-
-func (a *Article) renderTemplateExt(name string, params map[string]string) string {
-	return ""
-}
-
 func (a *Article) renderTemplateRecursive(name string, params map[string]string, g PageGetter, depth int) string {
 	if depth > 4 {
 		return ""
@@ -461,14 +559,14 @@ func (a *Article) renderTemplateRecursive(name string, params map[string]string,
 	//establish the type of template
 	switch templateType(name) {
 	case "magic":
-		return a.renderTemplateMagic(name, params)
+		return a.renderTemplateMagic(name, params, g)
 	case "ext":
-		return a.renderTemplateExt(name, params)
+		return a.renderTemplateExt(name, paramsToArgs(params), g)
 	}
 	//case "normal"
 	//based on the type of template
 	//for the name and each parameter, find templates and substite them in the proper order
-	mw, err := g.Get(WikiCanonicalFormNamespace(name, "Template"))
+	mw, err := g.Get(a.namespaces().WikiCanonicalFormNamespaceEsc(name, "Template", true))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Title:", a.Title, " Error retrieving:", name, " ->", err)
 		return ""
@@ -484,7 +582,7 @@ func (a *Article) TranscludeTemplatesRecursive(mw string, params map[string]stri
 			return ""
 		}
 		//strip nowiki noinclude etc here
-		mws := a.stripComments(mw)
+		mws = a.stripComments(mw)
 		isRedirect, redirect := a.checkRedirect(mws)
 		if !isRedirect {
 			break
@@ -499,6 +597,12 @@ func (a *Article) TranscludeTemplatesRecursive(mw string, params map[string]stri
 	mws = a.stripNoinclude(mws)
 
 	//	fmt.Println(ds[depth], "TranscludeTemplatesRecursive", mws)
+	return a.expandTemplates(mws, params, g, depth)
+}
+
+// expandTemplates returns mws with the templates it calls substituted by
+// their rendering.
+func (a *Article) expandTemplates(mws string, params map[string]string, g PageGetter, depth int) string {
 	mlt := findTemplates(mws)
 
 	last := 0
@@ -518,7 +622,66 @@ func (a *Article) TranscludeTemplatesRecursive(mw string, params map[string]stri
 
 var ds []string = []string{"   ", "      ", "         ", "            ", "               ", "                  "}
 
+// renderSegment returns mws[b:e] with the children of t found in that range
+// substituted by their rendering. Only those children get rendered.
+func (a *Article) renderSegment(mws string, t *template, b, e int, params map[string]string, g PageGetter, depth int) string {
+	out := make([]byte, 0, e-b)
+	last := b
+	for _, ct := range t.children {
+		if ct.b < b || ct.e > e {
+			continue
+		}
+		if !ct.rendered {
+			a.renderInnerTemplates(mws, ct, params, g, depth)
+		}
+		out = append(out, mws[last:ct.b]...)
+		out = append(out, ct.rt...)
+		last = ct.e
+	}
+	out = append(out, mws[last:e]...)
+	return string(out)
+}
+
+// renderParserFunction renders a parser function call, expanding its
+// arguments lazily. It returns the template name and the raw parameters.
+func (a *Article) renderParserFunction(mws string, t *template, tn string, pp [][]int, params map[string]string, g PageGetter, depth int) (string, map[string]string) {
+	seg := func(b, e int) lazyText {
+		return func() string {
+			return strings.TrimSpace(a.renderSegment(mws, t, b, e, params, g, depth))
+		}
+	}
+	args := make([]*pfArg, 0, len(pp)-1)
+	pm := make(map[string]string, len(pp)-1)
+	positional := 0
+	for i := 0; i < len(pp)-1; i++ {
+		arg := &pfArg{text: seg(pp[i][0]+1, pp[i+1][0])}
+		if len(pp[i]) > 1 {
+			arg.name = seg(pp[i][0]+1, pp[i][1])
+			arg.value = seg(pp[i][1]+1, pp[i+1][0])
+			pm[strings.TrimSpace(mws[pp[i][0]+1:pp[i][1]])] = strings.TrimSpace(mws[pp[i][1]+1 : pp[i+1][0]])
+		} else {
+			arg.value = arg.text
+			positional++
+			pm[fmt.Sprint(positional)] = strings.TrimSpace(mws[pp[i][0]+1 : pp[i+1][0]])
+		}
+		args = append(args, arg)
+	}
+	t.rendered = true
+	t.name, t.params = tn, pm
+	t.rt = a.renderTemplateExt(tn, args, g)
+	return tn, pm
+}
+
 func (a *Article) renderInnerTemplates(mws string, t *template, params map[string]string, g PageGetter, depth int) (string, map[string]string) {
+	if !t.isparam {
+		// parser functions only expand the arguments they need
+		pp := findTemplateParamPos(mws, t)
+		pp = append(pp, []int{t.e - 2})
+		tn := strings.TrimSpace(a.renderSegment(mws, t, t.b+2, pp[0][0], params, g, depth))
+		if templateType(tn) == "ext" {
+			return a.renderParserFunction(mws, t, tn, pp, params, g, depth)
+		}
+	}
 	// render inner templates first
 	//	fmt.Println(ds[depth], *t, "\n", ds[depth], "Template:\n", ds[depth], mws[t.b:t.e])
 	for _, it := range t.children {
@@ -604,6 +767,7 @@ func (a *Article) renderInnerTemplates(mws string, t *template, params map[strin
 		return "", nil
 	}
 	pm := make(map[string]string, len(pp))
+	positional := 0 // positional parameters are numbered apart from the named ones
 	for i := 0; i < len(pp)-1; i++ {
 		var name string
 		var param string
@@ -611,11 +775,14 @@ func (a *Article) renderInnerTemplates(mws string, t *template, params map[strin
 			name = fmt.Sprint(strings.TrimSpace(mw[pp[i][0]+1 : pp[i][1]]))
 			param = fmt.Sprint(strings.TrimSpace(mw[pp[i][1]+1 : pp[i+1][0]]))
 		} else {
-			name = fmt.Sprint(i + 1)
+			positional++
+			name = fmt.Sprint(positional)
 			param = fmt.Sprint(strings.TrimSpace(mw[pp[i][0]+1 : pp[i+1][0]]))
 		}
 		pm[name] = param
+		t.values = append(t.values, param)
 	}
+	t.name, t.params = tn, pm
 	t.rt = a.renderTemplateRecursive(tn, pm, g, depth+1)
 	return tn, pm
 }
@@ -26,12 +26,20 @@ func (a *Article) appendText(t string) {
 	a.text.WriteString(t)
 }
 
+// endLine appends a newline unless the text is empty or already ends with one.
+func (a *Article) endLine() {
+	if b := a.text.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		a.appendText("\n")
+	}
+}
+
 func (a *Article) genTextInternal(root *ParseNode, indent int) {
 	lastwasspace := false
 	for _, n := range root.Nodes {
 		var linkStart int
 		var fl FullWikiLink
 		isLink := false
+		itemEnd := false
 		tappend := ""
 		switch n.NType {
 		case "break":
@@ -45,8 +53,10 @@ func (a *Article) genTextInternal(root *ParseNode, indent int) {
 		case "image":
 			a.appendText("\n")
 			tappend = "\n"
+		case "gallery":
+			a.endLine()
 		case "link":
-			isLink = true
+			isLink = !n.Link.IsInterwiki()
 			linkStart = len(a.text.Bytes())
 			fl = FullWikiLink{Link: n.Link, Start: a.nchar}
 		case "html":
@@ -59,9 +69,20 @@ func (a *Article) genTextInternal(root *ParseNode, indent int) {
 				}
 			case "br":
 				a.appendText("\n")
-			case "ref":
-				a.appendText(" ")
+			case "table":
+				a.appendText("\n")
+				tappend = "\n"
+			case "tr", "caption":
+				tappend = "\n"
+			case "ul", "ol", "dl":
+				a.endLine()
+			case "li", "dt", "dd":
+				itemEnd = true
+			case "td", "th":
+				tappend = " "
 			}
+		case "ref":
+			a.appendText(" ")
 		}
 		if len(n.Nodes) > 0 {
 			a.genTextInternal(n, 0)
@@ -72,6 +93,9 @@ func (a *Article) genTextInternal(root *ParseNode, indent int) {
 			fl.Text = string(ttmp[linkStart:])
 			a.TextLinks = append(a.TextLinks, fl)
 		}
+		if itemEnd {
+			a.endLine()
+		}
 		lastwasspace = false
 		if n.NType == "space" {
 			lastwasspace = true
@@ -100,3 +124,14 @@ func (a *Article) genText() error {
 func (a *Article) GenText() error {
 	return a.genText()
 }
+
+// genNodesText generates the plain text of a list of nodes, along with the
+// links found in it, without touching the article text.
+func (a *Article) genNodesText(nodes []*ParseNode) (string, []FullWikiLink) {
+	b := &Article{
+		text:      new(bytes.Buffer),
+		TextLinks: make([]FullWikiLink, 0, 4),
+	}
+	b.genTextInternal(&ParseNode{NType: "root", Nodes: nodes}, 0)
+	return b.text.String(), b.TextLinks
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// reasons of InvalidTitleError, named after the MediaWiki messages
+const (
+	TitleEmpty             = "title-invalid-empty"
+	TitleIllegalCharacters = "title-invalid-characters"
+	TitleRelative          = "title-invalid-relative"
+	TitleMagicTilde        = "title-invalid-magic-tilde"
+	TitleTooLong           = "title-invalid-too-long"
+	TitleLeadingColon      = "title-invalid-leading-colon"
+	TitleTalkNamespace     = "title-invalid-talk-namespace"
+)
+
+// maximum length in bytes of the page name
+const (
+	maxTitleLength        = 255
+	maxSpecialTitleLength = 512
+)
+
+// InvalidTitleError is returned for titles MediaWiki would not accept.
+type InvalidTitleError struct {
+	Title  string
+	Reason string // one of the Title* constants
+}
+
+func (e *InvalidTitleError) Error() string {
+	return "Invalid title " + strconv.Quote(e.Title) + ": " + e.Reason
+}
+
+// characters not allowed by $wgLegalTitleChars, percent encoded characters
+// and html entities left after decoding
+var illegalTitleRe = regexp.MustCompile(`[<>\[\]{}|\x00-\x1f\x7f\x{fffd}]|%[0-9A-Fa-f]{2}|&[A-Za-z0-9\x{80}-\x{10ffff}]+;|&#[0-9]+;|&#x[0-9A-Fa-f]+;`)
+
+// ucfirst returns s with its first letter uppercased.
+func ucfirst(s string) string {
+	r, l := utf8.DecodeRuneInString(s)
+	if l == 0 || r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[l:]
+}
+
+func isRelativeTitle(t string) bool {
+	return t == "." || t == ".." ||
+		strings.HasPrefix(t, "./") || strings.HasPrefix(t, "../") ||
+		strings.Contains(t, "/./") || strings.Contains(t, "/../") ||
+		strings.HasSuffix(t, "/.") || strings.HasSuffix(t, "/..")
+}
+
+// ParseTitle returns the canonical form of title l in the standard
+// namespaces, or an InvalidTitleError if MediaWiki would reject it.
+func ParseTitle(l string) (WikiLink, error) {
+	return StandardNamespaceTable.ParseTitle(l)
+}
+
+// ParseTitle returns the canonical form of title l, or an
+// InvalidTitleError if MediaWiki would reject it: titles with illegal
+// characters, relative paths or too long are not valid.
+func (nt *NamespaceTable) ParseTitle(l string) (WikiLink, error) {
+	wl := nt.WikiCanonicalFormNamespaceEsc(l, "", true)
+	fail := func(reason string) (WikiLink, error) {
+		return wl, &InvalidTitleError{Title: l, Reason: reason}
+	}
+	switch {
+	case len(wl.PageName) == 0:
+		if len(wl.Namespace) == 0 && wl.HasAnchor() {
+			// a link to a section of the current page
+			return wl, nil
+		}
+		return fail(TitleEmpty)
+	case illegalTitleRe.MatchString(wl.FullPagename()):
+		return fail(TitleIllegalCharacters)
+	case wl.PageName[0] == ':':
+		return fail(TitleLeadingColon)
+	case isRelativeTitle(wl.PageName):
+		return fail(TitleRelative)
+	case strings.Contains(wl.PageName, "~~~"):
+		return fail(TitleMagicTilde)
+	}
+	max := maxTitleLength
+	if wl.NamespaceId == -1 {
+		max = maxSpecialTitleLength
+	}
+	if len(wl.PageName) > max {
+		return fail(TitleTooLong)
+	}
+	if wl.IsTalkPage() {
+		if i := strings.Index(wl.PageName, ":"); i > 0 {
+			if _, ok := nt.ByName(wl.PageName[:i]); ok {
+				return fail(TitleTalkNamespace)
+			}
+		}
+	}
+	return wl, nil
+}
@@ -20,7 +20,7 @@ import (
 	//	"bytes"
 	"errors"
 	"fmt"
-	//	"html"
+	"html"
 	"regexp"
 	"sort"
 	"strings"
@@ -138,10 +138,131 @@ func (a *Article) parseListLine(l string) ([]*Token, error) {
 }
 
 func (a *Article) parseTableLine(l string) ([]*Token, error) {
-	nt := make([]*Token, 0, 0)
+	nt := make([]*Token, 0, 4)
+	switch {
+	case strings.HasPrefix(l, "{|"):
+		attr, st := extractSpecials(l[2:])
+		nt = append(nt, &Token{TType: "tablestart", TAttr: strings.TrimSpace(attr)})
+		nt = append(nt, st...)
+	case strings.HasPrefix(l, "|}"):
+		nt = append(nt, &Token{TType: "tableend"})
+		if len(l) > 2 {
+			nnt, err := a.parseInlineText(l, 2, len(l))
+			if err != nil {
+				return nil, err
+			}
+			nt = append(nt, nnt...)
+		}
+	case strings.HasPrefix(l, "|-"):
+		attr, st := extractSpecials(strings.TrimLeft(l[1:], "-"))
+		nt = append(nt, &Token{TType: "tablerow", TAttr: strings.TrimSpace(attr)})
+		nt = append(nt, st...)
+	case strings.HasPrefix(l, "|+"):
+		nnt, err := a.parseTableCell(l, 2, len(l), "tablecaption")
+		if err != nil {
+			return nil, err
+		}
+		nt = append(nt, nnt...)
+	case l[0] == '!':
+		for _, c := range splitTableCells(l, 1, []string{"||", "!!"}) {
+			nnt, err := a.parseTableCell(l, c[0], c[1], "tableheader")
+			if err != nil {
+				return nil, err
+			}
+			nt = append(nt, nnt...)
+		}
+	default:
+		for _, c := range splitTableCells(l, 1, []string{"||"}) {
+			nnt, err := a.parseTableCell(l, c[0], c[1], "tablecell")
+			if err != nil {
+				return nil, err
+			}
+			nt = append(nt, nnt...)
+		}
+	}
 	return nt, nil
 }
 
+// splitTableCells returns the [start,end) byte ranges of the inline cells of
+// a table line, separated by any of seps. Separators inside html tags are
+// ignored, as MediaWiki does.
+func splitTableCells(l string, start int, seps []string) [][]int {
+	out := make([][]int, 0, 1)
+	intag := false
+	b := start
+	for i := start; i < len(l); i++ {
+		switch l[i] {
+		case '<':
+			intag = true
+			continue
+		case '>':
+			intag = false
+			continue
+		}
+		if intag {
+			continue
+		}
+		for _, sep := range seps {
+			if strings.HasPrefix(l[i:], sep) {
+				out = append(out, []int{b, i})
+				i += len(sep) - 1
+				b = i + 1
+				break
+			}
+		}
+	}
+	return append(out, []int{b, len(l)})
+}
+
+// parseTableCell tokenizes a single cell (or caption) found in l[start:end].
+// Text before the first pipe is taken as the cell attributes, unless it
+// contains the beginning of an internal link.
+func (a *Article) parseTableCell(l string, start, end int, ttype string) ([]*Token, error) {
+	nt := make([]*Token, 0, 2)
+	cs := start
+	attr := ""
+	if p := strings.IndexByte(l[start:end], '|'); p >= 0 && !strings.Contains(l[start:start+p], "[[") {
+		attr = l[start : start+p]
+		cs = start + p + 1
+	}
+	attr, st := extractSpecials(attr)
+	nt = append(nt, &Token{TType: ttype, TAttr: strings.TrimSpace(attr)})
+	nt = append(nt, st...)
+	nnt, err := a.parseInlineText(l, cs, end)
+	if err != nil {
+		return nil, err
+	}
+	return append(nt, nnt...), nil
+}
+
+// extractSpecials removes the special markers from s, returning the cleaned
+// string and the corresponding special tokens, so that templates and nowiki
+// blocks found in table attributes are not lost.
+func extractSpecials(s string) (string, []*Token) {
+	if strings.IndexByte(s, '\x07') < 0 {
+		return s, nil
+	}
+	nt := make([]*Token, 0, 2)
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\x07' && i+8 <= len(s) {
+			nt = append(nt, &Token{TType: "special", TText: s[i : i+8]})
+			i += 7
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return string(out), nt
+}
+
+func isTableToken(tt string) bool {
+	switch tt {
+	case "tablestart", "tableend", "tablerow", "tablecaption", "tableheader", "tablecell":
+		return true
+	}
+	return false
+}
+
 func isValidHTMLtag(tag string) bool {
 	return true
 }
@@ -201,7 +322,7 @@ dhtLoop:
 	var attr string
 
 	if tagend == 0 {
-		tag = l[tagstart:matchingpos]
+		tag = strings.TrimSuffix(l[tagstart:matchingpos], "/")
 		attr = ""
 	} else {
 		tag = l[tagstart:tagend]
@@ -211,6 +332,35 @@ dhtLoop:
 	//	e, tag, attr, closed, ok := decodeHTMLtag(l[pos:end])
 }
 
+var attrRe = regexp.MustCompile(`([^\s=/"']+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"']*)))?`)
+
+// parseAttributeList decodes the attributes of an html tag or table line
+// into a list of lowercase name and (html unescaped) value pairs, in order.
+// Only the first occurrence of an attribute is kept.
+func parseAttributeList(attr string) [][2]string {
+	out := make([][2]string, 0, 2)
+	seen := make(map[string]bool)
+	for _, m := range attrRe.FindAllStringSubmatch(attr, -1) {
+		name := strings.ToLower(m[1])
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		out = append(out, [2]string{name, html.UnescapeString(m[2] + m[3] + m[4])})
+	}
+	return out
+}
+
+// parseAttributes decodes the attributes of an html tag or table line into
+// a map from lowercase attribute name to (html unescaped) value.
+func parseAttributes(attr string) map[string]string {
+	out := make(map[string]string)
+	for _, p := range parseAttributeList(attr) {
+		out[p[0]] = p[1]
+	}
+	return out
+}
+
 func matchPrefixes(s string, prefixes []string) bool {
 	for i := range prefixes {
 		if len(s) >= len(prefixes[i]) && strings.EqualFold(s[:len(prefixes[i])], prefixes[i]) {
@@ -222,16 +372,32 @@ func matchPrefixes(s string, prefixes []string) bool {
 
 var extlinkre = regexp.MustCompile(`^(http:)|(ftp:)|()//[^\s]+`)
 
-func isExtLink(l string) bool {
+// DefaultURLProtocols are the protocols of external links recognized by
+// default, as in MediaWiki's $wgUrlProtocols.
+var DefaultURLProtocols = []string{
+	"bitcoin:", "ftp://", "ftps://", "geo:", "git://", "gopher://", "http://",
+	"https://", "irc://", "ircs://", "magnet:", "mailto:", "matrix:", "mms://",
+	"news:", "nntp://", "redis://", "sftp://", "sip:", "sips:", "sms:", "ssh://",
+	"svn://", "tel:", "telnet://", "urn:", "worldwind://", "xmpp:", "//",
+}
+
+func (a *Article) isExtLink(l string) bool {
 	// return extlinkre.MatchString(l)
-	return matchPrefixes(l, []string{"http://", "ftp://", "//"})
+	return matchPrefixes(l, a.context().URLProtocols)
 }
 
 var filelinkre = regexp.MustCompile(`(?i)^\[\[(?:image:)|(?:media:)|(?:file:)`)
 
-func possibleFileLink(l string) bool {
+// possibleFileLink tells if the link starting l points to the File or
+// Media namespace, under any of their names.
+func (a *Article) possibleFileLink(l string) bool {
 	// return filelinkre.MatchString(l)
-	return matchPrefixes(l, []string{"[[image:", "[[media:", "[[file:"})
+	i := strings.IndexAny(l[2:], ":|]")
+	if i < 0 || l[2+i] != ':' {
+		return false
+	}
+	ns, ok := a.namespaces().ByName(strings.TrimSpace(canoReSpaces.ReplaceAllString(l[2:2+i], " ")))
+	return ok && (ns.Id == 6 || ns.Id == -2)
 }
 
 func (a *Article) parseLink(l string) (int, []*Token, bool) {
@@ -239,8 +405,8 @@ func (a *Article) parseLink(l string) (int, []*Token, bool) {
 		return 0, nil, false
 	}
 	if l[1] == '[' {
-		if possibleFileLink(l) {
-			return a.parseFileLink(l)
+		if a.possibleFileLink(l) {
+			return a.parseFileLink(l, false)
 		}
 		return a.parseInternalLink(l)
 	}
@@ -299,11 +465,11 @@ func (a *Article) parseInternalLink(l string) (int, []*Token, bool) {
 	var nt []*Token = nil
 	var err error = nil
 	if pipepos == 0 {
-		innerstring := l[2:matchingpos]
+		innerstring := strings.TrimPrefix(l[2:matchingpos], ":")
 		if linktrail != 0 {
 			innerstring += l[matchingpos+2 : linktrail+1]
 		}
-		link = WikiCanonicalForm(l[2:matchingpos])
+		link = a.namespaces().WikiCanonicalFormNamespaceEsc(l[2:matchingpos], "", true)
 		nt = []*Token{&Token{TText: innerstring, TType: "text"}}
 
 	} else {
@@ -311,14 +477,36 @@ func (a *Article) parseInternalLink(l string) (int, []*Token, bool) {
 		if linktrail != 0 {
 			innerstring += l[matchingpos+2 : linktrail+1]
 		}
-		link = WikiCanonicalForm(l[2:pipepos])
+		link = a.namespaces().WikiCanonicalFormNamespaceEsc(l[2:pipepos], "", true)
 		if pipepos+1 < matchingpos {
+			a.inLink++
 			nt, err = a.parseInlineText(innerstring, 0, len(innerstring))
+			a.inLink--
 			if err != nil {
 				return 0, nil, false
 			}
 		}
 	}
+	target := l[2:matchingpos]
+	if pipepos != 0 {
+		target = l[2:pipepos]
+	}
+	leadingColon := strings.HasPrefix(strings.TrimSpace(target), ":")
+	if iwl, iw, ok := a.interwikiLink(target); ok {
+		if iw.Language && !leadingColon {
+			// interlanguage links are not part of the text
+			return matchingpos + 2, []*Token{{TLink: iwl, TType: "languagelink"}}, true
+		}
+		link = iwl
+	}
+	if link.NamespaceId == 14 && !link.IsInterwiki() && !leadingColon {
+		// category links are not part of the text
+		key := ""
+		if pipepos != 0 {
+			key = strings.TrimSpace(html.UnescapeString(l[pipepos+1 : matchingpos]))
+		}
+		return matchingpos + 2, []*Token{{TLink: link, TType: "category", TAttr: key}}, true
+	}
 	tokens := make([]*Token, 0, 2)
 	tokens = append(tokens, &Token{TLink: link, TType: "link"})
 	if nt != nil {
@@ -392,16 +580,18 @@ plLoop2:
 	var err error = nil
 	if spacepos == 0 {
 		link = l[1:matchingpos]
-		if !isExtLink(link) {
+		if !a.isExtLink(link) {
 			return 0, nil, false
 		}
 	} else {
 		link = l[1:spacepos]
-		if !isExtLink(link) {
+		if !a.isExtLink(link) {
 			return 0, nil, false
 		}
 		if spacepos+1 < matchingpos {
+			a.inLink++
 			nt, err = a.parseInlineText(l, spacepos+1, matchingpos)
+			a.inLink--
 			if err != nil {
 				return 0, nil, false
 			}
@@ -416,7 +606,9 @@ plLoop2:
 	return endpos, tokens, true
 }
 
-func (a *Article) parseFileLink(l string) (int, []*Token, bool) {
+// parseFileLink parses a file link starting at the beginning of l. In a
+// gallery only the options allowed in gallery lines are recognized.
+func (a *Article) parseFileLink(l string, gallery bool) (int, []*Token, bool) {
 	// possible internal link
 	pipepos := make([]int, 0, 0)
 	closed := false
@@ -470,23 +662,30 @@ plLoop:
 	var nt []*Token = nil
 	var err error = nil
 	if len(pipepos) == 0 {
-		link = WikiCanonicalForm(l[2:matchingpos])
+		link = a.namespaces().WikiCanonicalFormNamespaceEsc(l[2:matchingpos], "", true)
 		nt = []*Token{&Token{TText: l[2:matchingpos], TType: "text"}}
 
 	} else {
-		link = WikiCanonicalForm(l[2:pipepos[0]])
+		link = a.namespaces().WikiCanonicalFormNamespaceEsc(l[2:pipepos[0]], "", true)
+		pipepos = append(pipepos, matchingpos)
 		for i := 0; i < len(pipepos)-1; i++ {
 			pipes = append(pipes, l[pipepos[i]+1:pipepos[i+1]])
 		}
-		if pipepos[len(pipepos)-1]+1 < matchingpos {
-			nt, err = a.parseInlineText(l, pipepos[len(pipepos)-1]+1, matchingpos)
+		// the caption is the last segment which is not an option
+		_, c := a.parseMediaOptions(pipes, gallery)
+		if c >= 0 && pipepos[c]+1 < pipepos[c+1] {
+			nt, err = a.parseInlineText(l, pipepos[c]+1, pipepos[c+1])
 			if err != nil {
 				return 0, nil, false
 			}
 		}
 	}
 	tokens := make([]*Token, 0, 2)
-	tokens = append(tokens, &Token{TLink: link, TType: "filelink", TPipes: pipes})
+	ft := &Token{TLink: link, TType: "filelink", TPipes: pipes}
+	if gallery {
+		ft.TAttr = "gallery"
+	}
+	tokens = append(tokens, ft)
 	if nt != nil {
 		tokens = append(tokens, nt...)
 	}
@@ -494,6 +693,39 @@ plLoop:
 	return matchingpos + 2, tokens, true
 }
 
+// tokenizeGallery expands the content of a <gallery> tag into a gallery
+// token followed by a file link for each line. The File namespace is implied
+// and the lines which do not name a file are skipped, as in MediaWiki.
+func (a *Article) tokenizeGallery(g *Token) []*Token {
+	nss := a.namespaces()
+	fileNs := "File"
+	if ns := nss.ById(6); ns != nil {
+		fileNs = ns.Name
+	}
+	tokens := []*Token{{TType: "gallery", TAttr: g.TAttr}}
+	for _, line := range strings.Split(g.TText, "\n") {
+		line = strings.TrimSpace(line)
+		title := line
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			title = line[:i]
+		}
+		if len(strings.TrimSpace(title)) == 0 {
+			continue
+		}
+		link := nss.WikiCanonicalFormNamespaceEsc(title, fileNs, true)
+		if link.NamespaceId != 6 || len(link.PageName) == 0 {
+			continue
+		}
+		_, nt, ok := a.parseFileLink("[["+line+"]]", true)
+		if !ok {
+			continue
+		}
+		nt[0].TLink = link
+		tokens = append(tokens, nt...)
+	}
+	return append(tokens, &Token{TType: "closegallery"})
+}
+
 func min(a, b int) int {
 	if a <= b {
 		return a
@@ -521,6 +753,18 @@ func (a *Article) parseInlineText(l string, start, end int) ([]*Token, error) {
 
 	for pos := start; pos < end; {
 		rv, rune_len := utf8.DecodeRuneInString(l[pos:end])
+		if a.inLink == 0 && rv < utf8.RuneSelf && unicode.IsLetter(rv) && isWordStart(l, pos) {
+			e, lt, ok := a.parseFreeLink(l[pos:end])
+			if ok {
+				if tEnd > tStart {
+					nt = append(nt, &Token{TText: l[tStart:tEnd], TType: "text"})
+				}
+				nt = append(nt, lt...)
+				pos += e
+				tStart, tEnd = pos, pos
+				continue
+			}
+		}
 		switch rv {
 		case '<':
 			e, tag, attr, closed, ok := a.decodeHTMLtag(l[pos:end])
@@ -657,16 +901,42 @@ func (a *Article) lineType(l string) string {
 
 func (a *Article) Tokenize(mw string, g PageGetter) ([]*Token, error) {
 	mwnc := a.stripComments(mw)
-	mw_stripped, nowikipremathmap := a.stripNowikiPreMath(mwnc)
-	mw_tmpl, templatemap := a.processTemplates(mw_stripped, nowikipremathmap, g)
+	mw_stripped, nowikipremathmap, nwOffsets := a.stripNowikiPreMath(mwnc)
+	for _, t := range nowikipremathmap {
+		if t.TType == "gallery" {
+			// the captions of the gallery may call templates
+			t.TText = a.expandTemplates(t.TText, nil, g, 0)
+		}
+	}
+	src := &sourceText{text: mw, maps: []offsetMap{nwOffsets, commentOffsets(mw)}}
+	mw_tmpl, templatemap := a.processTemplates(mw_stripped, nowikipremathmap, g, src)
 	mw_links := a.preprocessLinks(mw_tmpl)
 
 	lines := strings.Split(mw_links, "\n")
 	tokens := make([]*Token, 0, 16)
+	tableDepth := 0
 	for _, l := range lines {
 		var nt []*Token
 		var err error = nil
 		lt := a.lineType(l)
+		if lt == "wikipre" || lt == "table" {
+			// table markup may be indented, and is plain text outside of a table
+			tl := strings.TrimLeft(l, " \t")
+			switch {
+			case strings.HasPrefix(tl, "{|"):
+				lt = "table"
+				l = tl
+				tableDepth++
+			case tableDepth > 0 && len(tl) > 0 && a.isTable(tl):
+				lt = "table"
+				l = tl
+				if strings.HasPrefix(tl, "|}") {
+					tableDepth--
+				}
+			case lt == "table":
+				lt = "normal"
+			}
+		}
 		switch lt {
 		case "normal":
 			nt, err = a.parseInlineText(l, 0, len(l))
@@ -692,13 +962,19 @@ func (a *Article) Tokenize(mw string, g PageGetter) ([]*Token, error) {
 		tokens = append(tokens, nt...)
 	}
 	specialcount := 0
-	for i := range tokens {
+	for i := 0; i < len(tokens); i++ {
 		if tokens[i].TType == "special" {
 			specialcount++
 			t, ok := templatemap[tokens[i].TText] //nowikipremathmap[tokens[i].TText]
 			if !ok {
 				return nil, errors.New("special not in map")
 			}
+			if t.TType == "gallery" {
+				gt := a.tokenizeGallery(t)
+				tokens = append(tokens[:i], append(gt, tokens[i+1:]...)...)
+				i += len(gt) - 1
+				continue
+			}
 			tokens[i] = t
 		}
 	}
@@ -719,12 +995,64 @@ func (a *Article) stripComments(mw string) string {
 	return commentsRe.ReplaceAllLiteralString(mw, "")
 }
 
+// offsetMap maps the byte offsets of a text obtained by removing or
+// replacing parts of another back to the offsets in the original: from pos
+// on, the offsets are shifted by shift.
+type offsetMap []struct{ pos, shift int }
+
+func (m offsetMap) orig(pos int) int {
+	shift := 0
+	for _, s := range m {
+		if s.pos > pos {
+			break
+		}
+		shift = s.shift
+	}
+	return pos + shift
+}
+
+// add records that the text from pos on is removed bytes shorter.
+func (m *offsetMap) add(pos, removed int) {
+	shift := 0
+	if len(*m) > 0 {
+		shift = (*m)[len(*m)-1].shift
+	}
+	*m = append(*m, struct{ pos, shift int }{pos, shift + removed})
+}
+
+// sourceText maps the offsets in the text processed by the tokenizer back
+// to the wikitext of the article.
+type sourceText struct {
+	text string
+	maps []offsetMap // from the last transformation to the first
+}
+
+func (s *sourceText) offset(pos int) int {
+	for _, m := range s.maps {
+		pos = m.orig(pos)
+	}
+	return pos
+}
+
+// commentOffsets returns the offset map of stripComments.
+func commentOffsets(mw string) offsetMap {
+	m := offsetMap{}
+	removed := 0
+	for _, c := range commentsRe.FindAllStringIndex(mw, -1) {
+		m.add(c[0]-removed, c[1]-c[0])
+		removed += c[1] - c[0]
+	}
+	return m
+}
+
 var nowikiOpenRe = regexp.MustCompile(`(?i)<\s*(nowiki)\s*[^>/]*>`)
 var nowikiCloseRe = regexp.MustCompile(`(?i)<(/nowiki)\s*[^>/]*>`)
 var preOpenRe = regexp.MustCompile(`(?i)<\s*(pre)\s*[^>]*>`)
 var preCloseRe = regexp.MustCompile(`(?i)<(/pre)\s*[^>]*>`)
 var mathOpenRe = regexp.MustCompile(`(?i)<\s*(math)\s*[^>]*>`)
 var mathCloseRe = regexp.MustCompile(`(?i)<(/math)\s*[^>]*>`)
+var galleryOpenRe = regexp.MustCompile(`(?i)<\s*(gallery)(?:[\s/][^>]*)?>`)
+var galleryCloseRe = regexp.MustCompile(`(?i)<(/gallery)(?:\s[^>]*)?>`)
 
 type ssInt [][]int
 
@@ -732,13 +1060,15 @@ func (a ssInt) Len() int           { return len(a) }
 func (a ssInt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ssInt) Less(i, j int) bool { return a[i][0] < a[j][0] }
 
-func (a *Article) stripNowikiPreMath(mw string) (string, map[string]*Token) {
+func (a *Article) stripNowikiPreMath(mw string) (string, map[string]*Token, offsetMap) {
 	nwoc := nowikiOpenRe.FindAllStringSubmatchIndex(mw, -1)
 	nwcc := nowikiCloseRe.FindAllStringSubmatchIndex(mw, -1)
 	poc := preOpenRe.FindAllStringSubmatchIndex(mw, -1)
 	pcc := preCloseRe.FindAllStringSubmatchIndex(mw, -1)
 	moc := mathOpenRe.FindAllStringSubmatchIndex(mw, -1)
 	mcc := mathCloseRe.FindAllStringSubmatchIndex(mw, -1)
+	goc := galleryOpenRe.FindAllStringSubmatchIndex(mw, -1)
+	gcc := galleryCloseRe.FindAllStringSubmatchIndex(mw, -1)
 
 	/*
 		nwoc = append(nwoc, []int{len(mw) + 1, len(mw) + 1})
@@ -766,18 +1096,27 @@ func (a *Article) stripNowikiPreMath(mw string) (string, map[string]*Token) {
 	for i := range mcc {
 		mcc[i] = append(mcc[i], 5)
 	}
-	am := make([][]int, 0, len(nwoc)+len(nwcc)+len(poc)+len(pcc)+len(moc)+len(mcc))
+	for i := range goc {
+		goc[i] = append(goc[i], 6)
+	}
+	for i := range gcc {
+		gcc[i] = append(gcc[i], 7)
+	}
+	am := make([][]int, 0, len(nwoc)+len(nwcc)+len(poc)+len(pcc)+len(moc)+len(mcc)+len(goc)+len(gcc))
 	am = append(am, nwoc...)
 	am = append(am, nwcc...)
 	am = append(am, poc...)
 	am = append(am, pcc...)
 	am = append(am, moc...)
 	am = append(am, mcc...)
+	am = append(am, goc...)
+	am = append(am, gcc...)
 	sort.Sort(ssInt(am))
 	//	fmt.Println(am)
 	tokens := make(map[string]*Token, len(am))
+	offsets := offsetMap{}
 	if len(am) == 0 {
-		return mw, tokens
+		return mw, tokens, offsets
 	}
 
 	ctype := -1
@@ -797,9 +1136,21 @@ func (a *Article) stripNowikiPreMath(mw string) (string, map[string]*Token) {
 				TAttr: mw[am[openidx][3] : am[openidx][1]-1],
 			}
 			out += special
+			offsets.add(len(out), am[i][1]-am[openidx][0]-len(special))
 			ctype = -1
 			lastclose = am[i][1]
 			count++
+		} else if (ctype == -1) && (am[i][4]&1 == 0) && (lastclose <= am[i][0]) && mw[am[i][1]-2] == '/' {
+			// a self-closing one, e.g. <gallery/>: it is empty
+			special := fmt.Sprintf("\x07%07d", count)
+			tokens[special] = &Token{
+				TType: strings.ToLower(mw[am[i][2]:am[i][3]]),
+				TAttr: strings.TrimRight(mw[am[i][3]:am[i][1]-1], " /"),
+			}
+			out += mw[lastclose:am[i][0]] + special
+			offsets.add(len(out), am[i][1]-am[i][0]-len(special))
+			lastclose = am[i][1]
+			count++
 		} else if (ctype == -1) && (am[i][4]&1 == 0) && (lastclose <= am[i][0]) {
 			// open a new one
 			out += mw[lastclose:am[i][0]]
@@ -817,12 +1168,13 @@ func (a *Article) stripNowikiPreMath(mw string) (string, map[string]*Token) {
 			TAttr: mw[am[openidx][3] : am[openidx][1]-1],
 		}
 		out += special
+		offsets.add(len(out), len(mw)-am[openidx][0]-len(special))
 		ctype = -1
 		count++
 	} else {
 		out += mw[lastclose:]
 	}
-	return out, tokens
+	return out, tokens, offsets
 }
 
 var multiLineLinksRe = regexp.MustCompile(`(?sm)\[\[[^\n|]*\|.*?\]\]`)
@@ -0,0 +1,96 @@
+/*
+Copyright (C) IBM Corporation 2015, Michele Franceschini <franceschini@us.ibm.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gowiki
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// DefaultUploadPath is the base URL of the files of Wikimedia Commons.
+const DefaultUploadPath = "//upload.wikimedia.org/wikipedia/commons"
+
+// fileName returns the name of the file of wl as stored by MediaWiki, with
+// underscores instead of spaces.
+func (wl *WikiLink) fileName() string {
+	return strings.Replace(wl.PageName, " ", "_", -1)
+}
+
+// hashPath returns the hashed directories of the file, e.g. "/a/ab".
+func (wl *WikiLink) hashPath() string {
+	sum := md5.Sum([]byte(wl.fileName()))
+	h := hex.EncodeToString(sum[:])
+	return "/" + h[:1] + "/" + h[:2]
+}
+
+// UploadPath returns the path of the file of a link to the File or Media
+// namespace relative to the upload directory of the wiki, e.g.
+// "/a/ab/Name.jpg". The name is percent encoded as in MediaWiki.
+func (wl *WikiLink) UploadPath() string {
+	return wl.hashPath() + "/" + wikiURLEncode(wl.fileName())
+}
+
+// UploadURL returns the URL of the original file below base, the upload
+// directory of the wiki. DefaultUploadPath is used if base is empty.
+func (wl *WikiLink) UploadURL(base string) string {
+	if len(base) == 0 {
+		base = DefaultUploadPath
+	}
+	return strings.TrimSuffix(base, "/") + wl.UploadPath()
+}
+
+// ThumbURL returns the URL of the thumbnail of the file scaled to width
+// pixels below base, the upload directory of the wiki. Vector images and
+// documents are rendered to png and jpg respectively. It returns the URL of
+// the original file if width is not positive.
+func (wl *WikiLink) ThumbURL(base string, width int) string {
+	if width <= 0 {
+		return wl.UploadURL(base)
+	}
+	if len(base) == 0 {
+		base = DefaultUploadPath
+	}
+	name := wl.fileName()
+	thumb := strconv.Itoa(width) + "px-" + name
+	ext := ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		ext = strings.ToLower(name[i+1:])
+	}
+	switch ext {
+	case "svg":
+		thumb += ".png"
+	case "pdf", "djvu":
+		thumb = "page1-" + thumb + ".jpg"
+	case "tif", "tiff":
+		thumb = "lossy-page1-" + thumb + ".jpg"
+	}
+	return strings.TrimSuffix(base, "/") + "/thumb" + wl.UploadPath() + "/" + wikiURLEncode(thumb)
+}
+
+// FileURL returns the URL of the original file of wl in the upload
+// directory of the wiki of the article.
+func (a *Article) FileURL(wl WikiLink) string {
+	return wl.UploadURL(a.context().UploadPath)
+}
+
+// ThumbURL returns the URL of the thumbnail of the file of wl scaled to
+// width pixels in the upload directory of the wiki of the article.
+func (a *Article) ThumbURL(wl WikiLink, width int) string {
+	return wl.ThumbURL(a.context().UploadPath, width)
+}
@@ -57,3 +57,15 @@ func (a *Article) CheckDisambiguation() bool {
 	}
 	return false
 }
+
+// collectLinks returns the internal links found in the subtrees of nodes.
+func collectLinks(nodes []*ParseNode) []WikiLink {
+	out := make([]WikiLink, 0, 2)
+	for _, n := range nodes {
+		if n.NType == "link" {
+			out = append(out, n.Link)
+		}
+		out = append(out, collectLinks(n.Nodes)...)
+	}
+	return out
+}